@@ -0,0 +1,67 @@
+package main
+
+import (
+	"time"
+
+	"github.com/aouyang1/go-matrixprofile/matrixprofile"
+	"github.com/gin-gonic/gin"
+)
+
+// Annotation describes an annotation vector that can be applied to the matrix
+// profile through the /mp endpoint
+type Annotation struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+
+	av matrixprofile.AV
+}
+
+// annotations lists the supported annotation vectors in the order they are
+// presented to clients. New annotation vectors only need to be added here.
+var annotations = []Annotation{
+	{
+		Name:        "default",
+		Description: "no adjustment, every subsequence is weighted equally",
+		av:          matrixprofile.DefaultAV,
+	},
+	{
+		Name:        "complexity",
+		Description: "favors subsequences with more complex shapes over simple ones",
+		av:          matrixprofile.ComplexityAV,
+	},
+	{
+		Name:        "meanstd",
+		Description: "favors subsequences with a standard deviation above the average",
+		av:          matrixprofile.MeanStdAV,
+	},
+	{
+		Name:        "clipping",
+		Description: "penalizes subsequences that spend time at the minimum or maximum of the series",
+		av:          matrixprofile.ClippingAV,
+	},
+}
+
+// annotationVector looks up an annotation vector by name. An empty name selects
+// the default annotation vector.
+func annotationVector(name string) (matrixprofile.AV, bool) {
+	if name == "" {
+		name = "default"
+	}
+	for _, a := range annotations {
+		if a.Name == name {
+			return a.av, true
+		}
+	}
+	return 0, false
+}
+
+func getAnnotations(c *gin.Context) {
+	start := time.Now()
+	endpoint := "/api/v1/annotations"
+	method := "GET"
+	buildCORSHeaders(c)
+
+	requestTotal.WithLabelValues(method, endpoint, "200").Inc()
+	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+	c.JSON(200, annotations)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// Span is an inclusive start and exclusive end range of series indices
+type Span struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+type MotifSpans struct {
+	MinDist float64 `json:"min_dist"`
+	Spans   []Span  `json:"spans"`
+}
+
+// Bundle holds everything needed to plot a matrix profile in one response. All
+// per index arrays are aligned to and have the same length as Series, with
+// positions that have no value set to null.
+type Bundle struct {
+	M            int           `json:"m"`
+	Series       []float64     `json:"series"`
+	MP           []*float64    `json:"mp"`
+	NormalizedMP []*float64    `json:"normalized_mp"`
+	CAC          []*float64    `json:"cac"`
+	Motifs       []MotifSpans  `json:"motifs"`
+	Discords     []Span        `json:"discords"`
+	Params       ComputeParams `json:"params"`
+
+	// BoundaryMask flags the positions whose distances are likely inflated by
+	// the edge effect so they can be de-emphasized when plotting
+	BoundaryMask []bool `json:"boundary_mask"`
+}
+
+// alignToSeries pads the values with nulls up to a length of n. NaN and infinite
+// values are also converted to null since they cannot be represented in JSON.
+func alignToSeries(vals []float64, n int) []*float64 {
+	aligned := make([]*float64, n)
+	for i := 0; i < len(vals) && i < n; i++ {
+		if !isFinite(vals[i]) {
+			continue
+		}
+		v := vals[i]
+		aligned[i] = &v
+	}
+	return aligned
+}
+
+func getBundle(c *gin.Context) {
+	start := time.Now()
+	endpoint := "/api/v1/bundle"
+	method := "GET"
+	session := sessions.Default(c)
+	buildCORSHeaders(c)
+
+	m, err := strconv.Atoi(c.Query("m"))
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	k, err := strconv.Atoi(c.Query("k"))
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	r, err := strconv.ParseFloat(c.Query("r"), 64)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	// optional smoothing window applied to the returned series only
+	smoothing, err := strconv.Atoi(c.DefaultQuery("smooth", "0"))
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	data, err := fetchData(c.Query("source"))
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	mp, computeParams, _, err := computeCachedMP(profileKey(data.Data, m), data.Data, m, "user")
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	_, _, cac := mp.Segment()
+
+	motifGroups, err := mp.TopKMotifs(k, r)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	discords, err := findDiscords(*mp, k, exclusionZone(mp.M), exclusionZone(mp.M))
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	// cache matrix profile for current session
+	if err := replaceMPCache(session, mp, computeParams); err != nil {
+		code := cacheErrorCode(err)
+		requestTotal.WithLabelValues(method, endpoint, strconv.Itoa(code)).Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(code, RespError{Error: err})
+		return
+	}
+
+	series := data.Data
+	if smoothing > 1 {
+		series = smooth(series, smoothing)
+	}
+
+	bundle := Bundle{
+		M:            mp.M,
+		Series:       series,
+		MP:           alignToSeries(mp.MP, len(series)),
+		NormalizedMP: alignToSeries(normalizedMP(*mp), len(series)),
+		CAC:          alignToSeries(cac, len(series)),
+		Motifs:       make([]MotifSpans, len(motifGroups)),
+		Discords:     make([]Span, len(discords)),
+		Params:       computeParams,
+		BoundaryMask: make([]bool, len(series)),
+	}
+	copy(bundle.BoundaryMask, boundaryArtifactMask(*mp))
+	for i, g := range motifGroups {
+		bundle.Motifs[i].MinDist = g.MinDist
+		bundle.Motifs[i].Spans = make([]Span, len(g.Idx))
+		for j, midx := range g.Idx {
+			bundle.Motifs[i].Spans[j] = Span{midx, midx + mp.M}
+		}
+	}
+	for i, didx := range discords {
+		bundle.Discords[i] = Span{didx, didx + mp.M}
+	}
+
+	requestTotal.WithLabelValues(method, endpoint, "200").Inc()
+	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+	c.JSON(200, bundle)
+}
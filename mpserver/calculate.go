@@ -1,6 +1,17 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/aouyang1/go-matrixprofile/matrixprofile"
@@ -9,7 +20,237 @@ import (
 )
 
 type Segment struct {
-	CAC []float64 `json:"cac"`
+	M         int           `json:"m"`
+	Log       *LogTransform `json:"log,omitempty"`
+	Detrend   Detrend       `json:"detrend"`
+	CAC       []float64     `json:"cac"`
+	ArcCounts []int         `json:"arc_counts"`
+	Params    ComputeParams `json:"params"`
+
+	// Approximate is set when the profile was computed with STAMP to fit within
+	// the requested time budget. Sampled then lists the positions whose distance
+	// profiles were computed, which are the only exact distances. Every other
+	// distance is an upper bound on the exact distance.
+	Approximate bool  `json:"approximate"`
+	Sampled     []int `json:"sampled,omitempty"`
+}
+
+// ComputeParams records everything needed to reproduce a matrix profile
+// computation. InputHash is the hex encoded sha256 of the input series.
+// ExclusionZone is the zone the profile was computed with, which motif and
+// discord discovery does not use when EXCLUSION_FRACTION is overridden.
+type ComputeParams struct {
+	Algorithm     string `json:"algorithm"`
+	M             int    `json:"m"`
+	Concurrency   int    `json:"concurrency"`
+	ExclusionZone int    `json:"exclusion_zone"`
+	Normalization string `json:"normalization"`
+	InputLength   int    `json:"input_length"`
+	InputHash     string `json:"input_hash"`
+
+	// Sample is the fraction of subsequences STAMP computed distance profiles
+	// for before the time budget ran out. It is omitted for exact computations.
+	Sample float64 `json:"sample,omitempty"`
+	// Seed is the seed of the order STAMP sampled subsequences in, which
+	// reproduces the same approximation for the same budget. It is omitted for
+	// exact computations.
+	Seed *int64 `json:"seed,omitempty"`
+}
+
+// hashSeries returns the hex encoded sha256 of the little endian bytes of the series
+func hashSeries(data []float64) string {
+	h := sha256.New()
+	b := make([]byte, 8)
+	for _, d := range data {
+		binary.LittleEndian.PutUint64(b, math.Float64bits(d))
+		h.Write(b)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// stompAlgorithm is the name reported for profiles computed by computeMP
+const stompAlgorithm = "stomp"
+
+// stampAlgorithm is the name reported for approximate profiles computed when a
+// time budget is too short for STOMP
+const stampAlgorithm = "stamp"
+
+// computeMP computes the self join matrix profile of the series with STOMP along
+// with the parameters used. The parameters are logged if logComputeParams is set.
+func computeMP(data []float64, m int) (*matrixprofile.MatrixProfile, ComputeParams, error) {
+	params := ComputeParams{
+		Algorithm:     stompAlgorithm,
+		M:             m,
+		Concurrency:   mpConcurrency,
+		ExclusionZone: profileExclusionZone(m),
+		Normalization: "z-normalized",
+		InputLength:   len(data),
+		InputHash:     hashSeries(data),
+	}
+	if logComputeParams {
+		log.Printf("computing matrix profile with %+v", params)
+	}
+
+	mp, err := matrixprofile.New(data, nil, m)
+	if err != nil {
+		return nil, params, err
+	}
+
+	if err = mp.Stomp(mpConcurrency); err != nil {
+		return nil, params, err
+	}
+	return mp, params, nil
+}
+
+// stampWithDeadline approximates the self join matrix profile with STAMP,
+// computing the distance profiles of subsequences in an order drawn from seed
+// until the deadline passes. The library's Stamp runs to completion once
+// started, so the sampling is done here to be able to stop it. Rows are handed to mpConcurrency
+// workers only while the deadline has not passed, so the deadline is overshot by
+// at most the time to compute one row, which is O(n*m).
+//
+// The returned positions, in ascending order, are the subsequences whose
+// distance profiles were computed. Their distances and indices are exact. Every
+// other distance only reflects the sampled subsequences it was compared with and
+// is an upper bound on the exact distance, or infinite with an index of -1 if it
+// was never compared with anything.
+func stampWithDeadline(data []float64, m int, seed int64, deadline time.Time) (*matrixprofile.MatrixProfile, []int, error) {
+	mp, err := matrixprofile.New(data, nil, m)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	n := len(data) - m + 1
+	mean, std := movMeanStd(data, m)
+	exzone := profileExclusionZone(m)
+
+	workers := mpConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	// each worker keeps its own profile so that no locking is needed, and they
+	// are merged once every worker is done
+	type partial struct {
+		dist    []float64
+		idx     []int
+		sampled []int
+	}
+	partials := make([]partial, workers)
+	rows := make(chan int)
+	var wg sync.WaitGroup
+	for w := range partials {
+		p := &partials[w]
+		p.dist = make([]float64, n)
+		p.idx = make([]int, n)
+		for i := range p.dist {
+			p.dist[i] = math.Inf(1)
+			p.idx[i] = -1
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dp := make([]float64, n)
+			for i := range rows {
+				if std[i] == 0 {
+					// constant subsequences have no distance to anything
+					continue
+				}
+				fillDistanceProfile(dp, data, m, mean, std, i)
+				for j, d := range dp {
+					if math.IsNaN(d) || (i-j <= exzone && j-i <= exzone) {
+						continue
+					}
+					if d < p.dist[i] {
+						p.dist[i], p.idx[i] = d, j
+					}
+					// the join is symmetric so the row also bounds every other
+					// subsequence's distance
+					if d < p.dist[j] {
+						p.dist[j], p.idx[j] = d, i
+					}
+				}
+				p.sampled = append(p.sampled, i)
+			}
+		}()
+	}
+
+	r := rand.New(rand.NewSource(seed))
+	for _, i := range r.Perm(n) {
+		if !time.Now().Before(deadline) {
+			break
+		}
+		rows <- i
+	}
+	close(rows)
+	wg.Wait()
+
+	mp.MP = partials[0].dist
+	mp.Idx = partials[0].idx
+	sampled := partials[0].sampled
+	for _, p := range partials[1:] {
+		for i, d := range p.dist {
+			if d < mp.MP[i] {
+				mp.MP[i], mp.Idx[i] = d, p.idx[i]
+			}
+		}
+		sampled = append(sampled, p.sampled...)
+	}
+	sort.Ints(sampled)
+
+	return mp, sampled, nil
+}
+
+// computeBudgetedMP computes the matrix profile within the time budget. The exact
+// profile is used when it is already cached or STOMP is estimated to fit the
+// budget, in which case STOMP runs to completion even if the estimate was low.
+// Otherwise an approximate profile is computed with stampWithDeadline and the
+// positions it sampled are returned. Approximate profiles are never added to the
+// shared profile cache. A nil seed samples in an order seeded from the clock, and
+// the seed used is reported in the parameters either way.
+func computeBudgetedMP(data []float64, m int, budget time.Duration, seed *int64) (*matrixprofile.MatrixProfile, ComputeParams, []int, error) {
+	deadline := time.Now().Add(budget)
+
+	key := profileKey(data, m)
+	if mp, params, ok := profiles.get(key); ok {
+		return mp, params, nil, nil
+	}
+	if estimateStompDuration(len(data), m, mpConcurrency) <= budget {
+		mp, params, _, err := computeCachedMP(key, data, m, "user")
+		return mp, params, nil, err
+	}
+
+	if seed == nil {
+		s := time.Now().UnixNano()
+		seed = &s
+	}
+
+	params := ComputeParams{
+		Algorithm:     stampAlgorithm,
+		M:             m,
+		Concurrency:   mpConcurrency,
+		ExclusionZone: profileExclusionZone(m),
+		Normalization: "z-normalized",
+		InputLength:   len(data),
+		InputHash:     hashSeries(data),
+		Seed:          seed,
+	}
+	if logComputeParams {
+		log.Printf("computing approximate matrix profile within %s with %+v", budget, params)
+	}
+
+	mp, sampled, err := stampWithDeadline(data, m, *seed, deadline)
+	if err != nil {
+		return nil, params, nil, err
+	}
+	if len(sampled) == 0 {
+		return nil, params, nil, errors.New("time budget is too short to sample any subsequence")
+	}
+	computeTotal.WithLabelValues("user").Inc()
+
+	params.Sample = float64(len(sampled)) / float64(len(mp.MP))
+	return mp, params, sampled, nil
 }
 
 func calculateMP(c *gin.Context) {
@@ -20,10 +261,26 @@ func calculateMP(c *gin.Context) {
 	buildCORSHeaders(c)
 
 	params := struct {
-		M      int    `json:"m"`
-		Source string `json:"source"`
+		M        int     `json:"m"`
+		Source   string  `json:"source"`
+		LogBase  float64 `json:"log_base"`  // 0 disables the log transform
+		LogShift bool    `json:"log_shift"` // offset non-positive series before the log transform
+		Detrend  string  `json:"detrend"`
+		// MaxDurationMs is the time budget for the computation, 0 for no limit
+		MaxDurationMs int `json:"max_duration_ms"`
+		// Seed fixes the sampling order of an approximate profile, which is
+		// otherwise seeded from the clock
+		Seed *int64 `json:"seed"`
+		// Dataset selects a preloaded dataset instead of a source
+		Dataset string `json:"dataset"`
+		// ResampleInterval puts the series onto a uniform grid with this many
+		// seconds between samples before profiling, as /data does with interval
+		ResampleInterval float64 `json:"resample_interval"`
+		ResampleMode     string  `json:"resample_mode"`
 	}{}
-	if err := c.BindJSON(&params); err != nil {
+	// the body is optional so that a preloaded dataset can be requested with
+	// just the query string, as in /calculate?dataset=foo&m=
+	if err := c.ShouldBindJSON(&params); err != nil && err != io.EOF {
 		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
 		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
 		c.JSON(500, RespError{Error: err})
@@ -32,7 +289,45 @@ func calculateMP(c *gin.Context) {
 	m := params.M
 	source := params.Source
 
+	// an empty m in the query leaves the window size to be picked from the data
+	if v := c.Query("m"); m == 0 && v != "" {
+		var err error
+		m, err = strconv.Atoi(v)
+		if err != nil {
+			requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+			serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+			c.JSON(500, RespError{Error: err})
+			return
+		}
+	}
+
+	dataset := params.Dataset
+	if dataset == "" {
+		dataset = c.Query("dataset")
+	}
+	if dataset != "" {
+		if source != "" {
+			requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+			serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+			c.JSON(500, RespError{Error: errors.New("only one of source or dataset can be provided")})
+			return
+		}
+		if _, ok := dataSources[datasetPrefix]; !ok {
+			requestTotal.WithLabelValues(method, endpoint, "404").Inc()
+			serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+			c.JSON(404, RespError{Error: errUnknownDataset})
+			return
+		}
+		source = datasetPrefix + dataset
+	}
+
 	data, err := fetchData(source)
+	if err == errUnknownDataset {
+		requestTotal.WithLabelValues(method, endpoint, "404").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(404, RespError{Error: errUnknownDataset})
+		return
+	}
 	if err != nil {
 		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
 		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
@@ -40,7 +335,10 @@ func calculateMP(c *gin.Context) {
 		return
 	}
 
-	mp, err := matrixprofile.New(data.Data, nil, m)
+	if params.ResampleMode == "" {
+		params.ResampleMode = "linear"
+	}
+	data, err = resampleData(data, params.ResampleInterval, params.ResampleMode)
 	if err != nil {
 		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
 		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
@@ -48,20 +346,83 @@ func calculateMP(c *gin.Context) {
 		return
 	}
 
-	if err = mp.Stomp(mpConcurrency); err != nil {
+	series := data.Data
+	var logParams *LogTransform
+	if params.LogBase != 0 {
+		var lt LogTransform
+		series, lt, err = logTransform(series, params.LogBase, params.LogShift)
+		if err != nil {
+			requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+			serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+			c.JSON(500, RespError{Error: err})
+			return
+		}
+		logParams = &lt
+	}
+
+	series, trend, err := detrend(series, params.Detrend)
+	if err != nil {
 		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
 		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
 		c.JSON(500, RespError{Error: err})
 		return
 	}
 
+	if m == 0 {
+		// no window size was provided so pick the most likely one from the data
+		windows, err := suggestWindows(series, 1)
+		if err != nil {
+			requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+			serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+			c.JSON(500, RespError{Error: err})
+			return
+		}
+		m = windows[0]
+	}
+
+	var mp *matrixprofile.MatrixProfile
+	var computeParams ComputeParams
+	var sampled []int
+	if params.MaxDurationMs > 0 {
+		mp, computeParams, sampled, err = computeBudgetedMP(series, m, time.Duration(params.MaxDurationMs)*time.Millisecond, params.Seed)
+	} else {
+		mp, computeParams, _, err = computeCachedMP(profileKey(series, m), series, m, "user")
+	}
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	// the strongest discord is the largest distance, which is all the gauge needs
+	// from the summary
+	if dist, idx := maxIgnoreNaN(mp.MP); idx >= 0 {
+		strongestDiscordDistance.WithLabelValues(sourceLabel(source)).Set(dist)
+	}
+
 	// compute the corrected arc curve based on the current index matrix profile
 	_, _, cac := mp.Segment()
 
 	// cache matrix profile for current session
-	storeMPCache(session, mp)
+	if err := replaceMPCache(session, mp, computeParams); err != nil {
+		code := cacheErrorCode(err)
+		requestTotal.WithLabelValues(method, endpoint, strconv.Itoa(code)).Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(code, RespError{Error: err})
+		return
+	}
 
 	requestTotal.WithLabelValues(method, endpoint, "200").Inc()
 	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
-	c.JSON(200, Segment{cac})
+	c.JSON(200, Segment{
+		M:           m,
+		Log:         logParams,
+		Detrend:     trend,
+		CAC:         cac,
+		ArcCounts:   arcCounts(*mp),
+		Params:      computeParams,
+		Approximate: computeParams.Algorithm == stampAlgorithm,
+		Sampled:     sampled,
+	})
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestComputeParamsExclusionZone(t *testing.T) {
+	defer func(f float64) { exclusionFraction = f }(exclusionFraction)
+
+	mp := randomWalkMP(t, 200, 16)
+	for _, fraction := range []float64{0.1, 0.5, 1} {
+		exclusionFraction = fraction
+
+		computed, params, err := computeMP(mp.A, 16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the reported zone is the one the profile was computed with, whatever
+		// fraction discovery uses
+		if params.ExclusionZone != 8 {
+			t.Errorf("expected an exclusion zone of 8 with a fraction of %f but got %d", fraction, params.ExclusionZone)
+		}
+		for i, j := range computed.Idx {
+			if j-i <= params.ExclusionZone && i-j <= params.ExclusionZone {
+				t.Errorf("neighbor %d of %d is within the reported exclusion zone %d", j, i, params.ExclusionZone)
+			}
+		}
+	}
+}
+
+func TestInitExclusionFraction(t *testing.T) {
+	defer func(f float64) { exclusionFraction = f }(exclusionFraction)
+
+	t.Setenv("EXCLUSION_FRACTION", "0.25")
+	if err := initExclusionFraction(); err != nil {
+		t.Fatal(err)
+	}
+	if exclusionFraction != 0.25 {
+		t.Errorf("expected an exclusion fraction of 0.25 but got %f", exclusionFraction)
+	}
+
+	for _, v := range []string{"-0.5", "NaN", "+Inf", "half"} {
+		t.Setenv("EXCLUSION_FRACTION", v)
+		if err := initExclusionFraction(); err == nil {
+			t.Errorf("expected an error for EXCLUSION_FRACTION=%s", v)
+		}
+	}
+}
+
+func TestStampWithDeadlineMatchesStomp(t *testing.T) {
+	mp := randomWalkMP(t, 300, 16)
+
+	// a deadline that is never reached samples every subsequence, which is exact
+	approx, sampled, err := stampWithDeadline(mp.A, 16, 1, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sampled) != len(mp.MP) {
+		t.Fatalf("expected all %d subsequences to be sampled but got %d", len(mp.MP), len(sampled))
+	}
+	for i := range mp.MP {
+		if math.Abs(approx.MP[i]-mp.MP[i]) > 1e-6 {
+			t.Errorf("expected distance %f at %d but got %f", mp.MP[i], i, approx.MP[i])
+		}
+	}
+}
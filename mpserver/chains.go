@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/aouyang1/go-matrixprofile/matrixprofile"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// Chain is a walk through the matrix profile index. Score measures how smoothly
+// the pattern evolves along the chain, see chainScore.
+type Chain struct {
+	M         int     `json:"m"`
+	Algorithm string  `json:"algorithm"`
+	Chain     []int   `json:"chain"`
+	Score     float64 `json:"score"`
+}
+
+// followChain walks the matrix profile index from start, repeatedly jumping to
+// the nearest neighbor of the current subsequence. The walk stops after maxLen
+// subsequences, when a subsequence is revisited or when a neighbor index is out of
+// range. The returned chain always begins with start.
+func followChain(mp matrixprofile.MatrixProfile, start, maxLen int) ([]int, error) {
+	if start < 0 || start >= len(mp.Idx) {
+		return nil, fmt.Errorf("chain start %d is out of range [0, %d)", start, len(mp.Idx))
+	}
+	if maxLen < 1 {
+		return nil, errors.New("maximum chain length must be at least 1")
+	}
+
+	visited := make(map[int]bool)
+	chain := []int{start}
+	visited[start] = true
+	for cur := start; len(chain) < maxLen; {
+		next := mp.Idx[cur]
+		if next < 0 || next >= len(mp.Idx) || visited[next] {
+			break
+		}
+		chain = append(chain, next)
+		visited[next] = true
+		cur = next
+	}
+
+	return chain, nil
+}
+
+// chainScore measures how consistently the pattern drifts along a chain. The
+// drift of each link is the difference between the z-normalized subsequences it
+// connects and the score is the mean cosine similarity of consecutive drifts. A
+// score near 1 means the pattern keeps changing in the same direction, near 0
+// that it wanders, and negative that it oscillates. Chains with fewer than three
+// members have no consecutive drifts and score 0.
+func chainScore(mp matrixprofile.MatrixProfile, chain []int) (float64, error) {
+	if len(chain) < 3 {
+		return 0, nil
+	}
+
+	normed := make([][]float64, len(chain))
+	for i, idx := range chain {
+		subseq, err := subsequence(mp, idx)
+		if err != nil {
+			return 0, err
+		}
+		normed[i], err = matrixprofile.ZNormalize(subseq)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var sum float64
+	var links int
+	for i := 2; i < len(normed); i++ {
+		var dot, prevNorm, curNorm float64
+		for k := range normed[i] {
+			prev := normed[i-1][k] - normed[i-2][k]
+			cur := normed[i][k] - normed[i-1][k]
+			dot += prev * cur
+			prevNorm += prev * prev
+			curNorm += cur * cur
+		}
+		if prevNorm == 0 || curNorm == 0 {
+			// identical neighbors have no drift to compare
+			continue
+		}
+		sum += dot / math.Sqrt(prevNorm*curNorm)
+		links++
+	}
+	if links == 0 {
+		return 0, nil
+	}
+
+	return sum / float64(links), nil
+}
+
+func getChain(c *gin.Context) {
+	start := time.Now()
+	endpoint := "/api/v1/chain"
+	method := "GET"
+	session := sessions.Default(c)
+	buildCORSHeaders(c)
+
+	startIdx, err := strconv.Atoi(c.Query("start"))
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	maxLen, err := strconv.Atoi(c.Query("maxlen"))
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	v := fetchMPCache(session)
+	var mp matrixprofile.MatrixProfile
+	if v == nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{
+			Error:        errors.New("matrix profile is not initialized to follow a chain"),
+			CacheExpired: true,
+		})
+		return
+	} else {
+		mp = v.(matrixprofile.MatrixProfile)
+	}
+
+	chain, err := followChain(mp, startIdx, maxLen)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	score, err := chainScore(mp, chain)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	requestTotal.WithLabelValues(method, endpoint, "200").Inc()
+	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+	c.JSON(200, Chain{
+		M:         mp.M,
+		Algorithm: fetchComputeParams(session).Algorithm,
+		Chain:     chain,
+		Score:     score,
+	})
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/aouyang1/go-matrixprofile/matrixprofile"
+)
+
+// The version is written as the first byte of every encoded matrix profile and a
+// new one must be added whenever the layout below changes. Version 2 differs from
+// version 1 only in storing the index as int32, which halves its size.
+const (
+	mpCodecVersion      byte = 1
+	mpCodecVersionIdx32 byte = 2
+)
+
+// profileIndex holds a matrix profile index in as little memory as it fits in.
+// Positions are stored as int32 unless one of them does not fit, which can only
+// happen for series of 2^31 or more points or for the sentinel values the library
+// leaves in uncomputed entries, in which case they are stored as int64. Only the
+// codec reads the storage slices directly, everything else uses the accessors.
+type profileIndex struct {
+	idx32 []int32
+	idx64 []int64
+}
+
+func newProfileIndex(idx []int) profileIndex {
+	for _, j := range idx {
+		if j < math.MinInt32 || j > math.MaxInt32 {
+			idx64 := make([]int64, len(idx))
+			for i, j := range idx {
+				idx64[i] = int64(j)
+			}
+			return profileIndex{idx64: idx64}
+		}
+	}
+
+	idx32 := make([]int32, len(idx))
+	for i, j := range idx {
+		idx32[i] = int32(j)
+	}
+	return profileIndex{idx32: idx32}
+}
+
+// Len returns the number of positions in the index
+func (pi profileIndex) Len() int {
+	if pi.idx64 != nil {
+		return len(pi.idx64)
+	}
+	return len(pi.idx32)
+}
+
+// At returns the nearest neighbor of the subsequence at i
+func (pi profileIndex) At(i int) int {
+	if pi.idx64 != nil {
+		return int(pi.idx64[i])
+	}
+	return int(pi.idx32[i])
+}
+
+// Ints expands the index to the []int the library works with
+func (pi profileIndex) Ints() []int {
+	idx := make([]int, pi.Len())
+	for i := range idx {
+		idx[i] = pi.At(i)
+	}
+	return idx
+}
+
+// sizeBytes returns the memory held by the index storage
+func (pi profileIndex) sizeBytes() int {
+	if pi.idx64 != nil {
+		return 8 * len(pi.idx64)
+	}
+	return 4 * len(pi.idx32)
+}
+
+// is32 reports whether the index is stored as int32
+func (pi profileIndex) is32() bool {
+	return pi.idx64 == nil
+}
+
+// encodeMP packs a self join matrix profile into a compact little endian binary
+// blob for caching. Only the series, window size, annotation vector, profile and
+// index are stored. Everything else is recomputed by decodeMP. The layout is
+//
+//	version byte | m uint32 | av int64 | len(A) uint32 | A []float64 |
+//	len(MP) uint32 | MP []float64 | Idx []int32 or []int64
+//
+// The index is stored as int32 unless one of its values does not fit.
+func encodeMP(mp *matrixprofile.MatrixProfile) ([]byte, error) {
+	if len(mp.MP) != len(mp.Idx) {
+		return nil, errors.New("matrix profile and index lengths do not match")
+	}
+
+	pi := newProfileIndex(mp.Idx)
+	version, idxSize := mpCodecVersionIdx32, 4
+	if !pi.is32() {
+		version, idxSize = mpCodecVersion, 8
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Grow(1 + 4 + 8 + 4 + 8*len(mp.A) + 4 + (8+idxSize)*len(mp.MP))
+
+	buf.WriteByte(version)
+	fields := []interface{}{
+		uint32(mp.M),
+		int64(mp.AV),
+		uint32(len(mp.A)),
+		mp.A,
+		uint32(len(mp.MP)),
+		mp.MP,
+	}
+	for _, f := range fields {
+		if err := binary.Write(buf, binary.LittleEndian, f); err != nil {
+			return nil, err
+		}
+	}
+
+	var idx interface{} = pi.idx64
+	if pi.is32() {
+		idx = pi.idx32
+	}
+	if err := binary.Write(buf, binary.LittleEndian, idx); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decodeMP unpacks a blob produced by encodeMP, recomputing the fields that were
+// not stored
+func decodeMP(b []byte) (matrixprofile.MatrixProfile, error) {
+	stored, err := decodeStoredMP(b)
+	if err != nil {
+		return matrixprofile.MatrixProfile{}, err
+	}
+
+	mp, err := matrixprofile.New(stored.A, nil, stored.M)
+	if err != nil {
+		return matrixprofile.MatrixProfile{}, err
+	}
+	mp.AV = stored.AV
+	mp.MP = stored.MP
+	mp.Idx = stored.Idx
+
+	return *mp, nil
+}
+
+// decodeStoredMP unpacks only the fields stored by encodeMP. The library's
+// derived fields are left empty, so the result must go through matrixprofile.New
+// before any of its methods are called.
+func decodeStoredMP(b []byte) (matrixprofile.MatrixProfile, error) {
+	r := bytes.NewReader(b)
+
+	version, err := r.ReadByte()
+	if err != nil {
+		return matrixprofile.MatrixProfile{}, err
+	}
+	idxSize := 8
+	switch version {
+	case mpCodecVersion:
+	case mpCodecVersionIdx32:
+		idxSize = 4
+	default:
+		return matrixprofile.MatrixProfile{}, fmt.Errorf("unsupported matrix profile encoding version %d", version)
+	}
+
+	var m, n uint32
+	var av int64
+	if err := binary.Read(r, binary.LittleEndian, &m); err != nil {
+		return matrixprofile.MatrixProfile{}, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &av); err != nil {
+		return matrixprofile.MatrixProfile{}, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return matrixprofile.MatrixProfile{}, err
+	}
+	if int(n)*8 > r.Len() {
+		return matrixprofile.MatrixProfile{}, errors.New("encoded matrix profile is truncated")
+	}
+	a := make([]float64, n)
+	if err := binary.Read(r, binary.LittleEndian, a); err != nil {
+		return matrixprofile.MatrixProfile{}, err
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return matrixprofile.MatrixProfile{}, err
+	}
+	if int(n)*(8+idxSize) > r.Len() {
+		return matrixprofile.MatrixProfile{}, errors.New("encoded matrix profile is truncated")
+	}
+	profile := make([]float64, n)
+	if err := binary.Read(r, binary.LittleEndian, profile); err != nil {
+		return matrixprofile.MatrixProfile{}, err
+	}
+	var pi profileIndex
+	if idxSize == 4 {
+		pi.idx32 = make([]int32, n)
+		if err := binary.Read(r, binary.LittleEndian, pi.idx32); err != nil {
+			return matrixprofile.MatrixProfile{}, err
+		}
+	} else {
+		pi.idx64 = make([]int64, n)
+		if err := binary.Read(r, binary.LittleEndian, pi.idx64); err != nil {
+			return matrixprofile.MatrixProfile{}, err
+		}
+	}
+
+	return matrixprofile.MatrixProfile{
+		A:        a,
+		B:        a,
+		N:        len(a),
+		M:        int(m),
+		SelfJoin: true,
+		AV:       matrixprofile.AV(av),
+		MP:       profile,
+		Idx:      pi.Ints(),
+	}, nil
+}
+
+// mpSpotChecks is the number of profile entries recomputed by validateMP
+const mpSpotChecks = 3
+
+// validateMP checks that a decoded matrix profile is consistent with its series.
+// The profile and index must have one entry per subsequence, every index of a
+// finite distance must point at a subsequence, and a few evenly spaced distances
+// are recomputed against the series. This catches truncated blobs or profiles
+// that were paired with the wrong series before they produce garbage downstream.
+func validateMP(mp matrixprofile.MatrixProfile) error {
+	if mp.M < 2 || mp.M > len(mp.A) {
+		return fmt.Errorf("window size %d is invalid for a series of length %d", mp.M, len(mp.A))
+	}
+	n := len(mp.A) - mp.M + 1
+	if len(mp.MP) != n || len(mp.Idx) != n {
+		return fmt.Errorf("expected %d profile entries but found %d distances and %d indices", n, len(mp.MP), len(mp.Idx))
+	}
+
+	for i, d := range mp.MP {
+		if !isFinite(d) {
+			// constant subsequences or ones without a match leave the index meaningless
+			continue
+		}
+		if d < 0 {
+			return fmt.Errorf("invalid distance %f at index %d", d, i)
+		}
+		if mp.Idx[i] < 0 || mp.Idx[i] >= n {
+			return fmt.Errorf("matrix profile index %d at %d is out of bounds", mp.Idx[i], i)
+		}
+	}
+
+	for c := 0; c < mpSpotChecks; c++ {
+		i := c * (n - 1) / (mpSpotChecks - 1)
+		if !isFinite(mp.MP[i]) {
+			continue
+		}
+
+		qs, err := subsequence(mp, i)
+		if err != nil {
+			return err
+		}
+		ts, err := subsequence(mp, mp.Idx[i])
+		if err != nil {
+			return err
+		}
+
+		q, err := matrixprofile.ZNormalize(qs)
+		if err != nil {
+			// constant subsequences have no meaningful distance to check against
+			continue
+		}
+		t, err := matrixprofile.ZNormalize(ts)
+		if err != nil {
+			continue
+		}
+
+		var d float64
+		for k := range q {
+			d += (q[k] - t[k]) * (q[k] - t[k])
+		}
+		d = math.Sqrt(d)
+		// the profile accumulates rounding error across the dot product updates
+		if math.Abs(d-mp.MP[i]) > 1e-3*math.Max(1, d) {
+			return fmt.Errorf("distance at index %d is %f but recomputes to %f", i, mp.MP[i], d)
+		}
+	}
+
+	return nil
+}
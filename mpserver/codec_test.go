@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/aouyang1/go-matrixprofile/matrixprofile"
+)
+
+// randomWalkMP computes the matrix profile of a random walk of length n
+func randomWalkMP(tb testing.TB, n, m int) *matrixprofile.MatrixProfile {
+	r := rand.New(rand.NewSource(1))
+	data := make([]float64, n)
+	for i := 1; i < n; i++ {
+		data[i] = data[i-1] + r.NormFloat64()
+	}
+
+	mp, err := matrixprofile.New(data, nil, m)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err = mp.Stomp(1); err != nil {
+		tb.Fatal(err)
+	}
+	return mp
+}
+
+func TestEncodeMPRoundTrip(t *testing.T) {
+	mp := randomWalkMP(t, 200, 16)
+	mp.AV = matrixprofile.ComplexityAV
+
+	// an index that does not fit in an int32 forces the version 1 layout
+	wide := *mp
+	wide.Idx = append([]int(nil), mp.Idx...)
+	wide.MP = append([]float64(nil), mp.MP...)
+	wide.Idx[0] = math.MaxInt64
+	wide.MP[0] = math.Inf(1)
+
+	testData := []struct {
+		mp      *matrixprofile.MatrixProfile
+		version byte
+	}{
+		{mp, mpCodecVersionIdx32},
+		{&wide, mpCodecVersion},
+	}
+
+	for _, d := range testData {
+		b, err := encodeMP(d.mp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b[0] != d.version {
+			t.Errorf("expected encoding version %d but got %d", d.version, b[0])
+		}
+
+		out, err := decodeMP(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.M != d.mp.M || out.AV != d.mp.AV {
+			t.Errorf("expected m=%d and av=%d but got m=%d and av=%d", d.mp.M, d.mp.AV, out.M, out.AV)
+		}
+		if len(out.A) != len(d.mp.A) || len(out.MP) != len(d.mp.MP) || len(out.Idx) != len(d.mp.Idx) {
+			t.Fatalf("expected lengths %d, %d and %d but got %d, %d and %d", len(d.mp.A), len(d.mp.MP), len(d.mp.Idx), len(out.A), len(out.MP), len(out.Idx))
+		}
+		for i := range out.A {
+			if out.A[i] != d.mp.A[i] {
+				t.Fatalf("expected %f at series index %d but got %f", d.mp.A[i], i, out.A[i])
+			}
+		}
+		for i := range out.MP {
+			if out.MP[i] != d.mp.MP[i] || out.Idx[i] != d.mp.Idx[i] {
+				t.Fatalf("expected (%f, %d) at profile index %d but got (%f, %d)", d.mp.MP[i], d.mp.Idx[i], i, out.MP[i], out.Idx[i])
+			}
+		}
+	}
+}
+
+func TestDecodeMPInvalid(t *testing.T) {
+	b, err := encodeMP(randomWalkMP(t, 100, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testData := [][]byte{
+		nil,
+		{0},
+		{99, 0, 0, 0, 0},
+		b[:len(b)/2],
+		b[:len(b)-1],
+	}
+
+	for _, d := range testData {
+		if _, err := decodeMP(d); err == nil {
+			t.Errorf("expected an error decoding %d bytes", len(d))
+		}
+	}
+}
+
+func TestProfileIndex(t *testing.T) {
+	testData := []struct {
+		idx  []int
+		is32 bool
+	}{
+		{[]int{}, true},
+		{[]int{3, 0, -1, math.MaxInt32}, true},
+		{[]int{3, 0, math.MaxInt32 + 1}, false},
+		{[]int{math.MaxInt64, 1}, false},
+	}
+
+	for _, d := range testData {
+		pi := newProfileIndex(d.idx)
+		if pi.is32() != d.is32 {
+			t.Errorf("expected int32 storage to be %t for %v", d.is32, d.idx)
+		}
+		if pi.Len() != len(d.idx) {
+			t.Fatalf("expected a length of %d but got %d", len(d.idx), pi.Len())
+		}
+		for i, j := range pi.Ints() {
+			if j != d.idx[i] || pi.At(i) != d.idx[i] {
+				t.Errorf("expected %d at %d but got %d", d.idx[i], i, j)
+			}
+		}
+	}
+}
+
+// BenchmarkEncodeMP reports the encoded size of a matrix profile against gob
+// encoding the whole struct, which is how profiles were cached before encodeMP
+func BenchmarkEncodeMP(b *testing.B) {
+	mp := randomWalkMP(b, 5000, 64)
+
+	b.Run("compact", func(b *testing.B) {
+		var size int
+		for i := 0; i < b.N; i++ {
+			blob, err := encodeMP(mp)
+			if err != nil {
+				b.Fatal(err)
+			}
+			size = len(blob)
+		}
+		b.ReportMetric(float64(size), "bytes")
+	})
+
+	b.Run("gob", func(b *testing.B) {
+		var size int
+		for i := 0; i < b.N; i++ {
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).Encode(mp); err != nil {
+				b.Fatal(err)
+			}
+			size = buf.Len()
+		}
+		b.ReportMetric(float64(size), "bytes")
+	})
+}
+
+func TestComputedMPValidates(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	data := make([]float64, 500)
+	for i := 1; i < len(data); i++ {
+		data[i] = data[i-1] + r.NormFloat64()
+	}
+	// a flat stretch leaves subsequences with no variance in the profile
+	for i := 200; i < 240; i++ {
+		data[i] = data[199]
+	}
+
+	for _, m := range []int{4, 32, 100} {
+		mp, _, err := computeMP(data, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := encodeMP(mp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := decodeMP(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := validateMP(decoded); err != nil {
+			t.Errorf("expected the computed profile with m=%d to validate but got %v", m, err)
+		}
+	}
+}
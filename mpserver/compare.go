@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/aouyang1/go-matrixprofile/matrixprofile"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// profileTolerance is the relative difference below which two distances are
+// considered equal by compareProfiles
+const profileTolerance = 1e-6
+
+// ProfileDiff quantifies how two matrix profiles over the same series differ.
+// The absolute differences only include positions where both distances are
+// finite. DistanceMismatches lists the positions whose distances differ, or where
+// only one of the distances is finite, and IndexMismatches the positions whose
+// nearest neighbor index differs. Ties in distance can produce index mismatches
+// without a distance mismatch.
+type ProfileDiff struct {
+	MaxAbsDiff         float64 `json:"max_abs_diff"`
+	MeanAbsDiff        float64 `json:"mean_abs_diff"`
+	DistanceMismatches []int   `json:"distance_mismatches"`
+	IndexMismatches    []int   `json:"index_mismatches"`
+}
+
+// compareProfiles reports the divergence between two matrix profiles. Positions
+// where neither distance is finite count as equal.
+func compareProfiles(a, b matrixprofile.MatrixProfile) (ProfileDiff, error) {
+	var diff ProfileDiff
+	if a.M != b.M {
+		return diff, fmt.Errorf("window sizes %d and %d differ", a.M, b.M)
+	}
+	if len(a.MP) != len(b.MP) || len(a.Idx) != len(b.Idx) || len(a.MP) != len(a.Idx) {
+		return diff, errors.New("matrix profiles have different lengths")
+	}
+
+	var sum float64
+	var compared int
+	for i := range a.MP {
+		if a.Idx[i] != b.Idx[i] {
+			diff.IndexMismatches = append(diff.IndexMismatches, i)
+		}
+
+		fa, fb := isFinite(a.MP[i]), isFinite(b.MP[i])
+		if !fa && !fb {
+			continue
+		}
+		if fa != fb {
+			diff.DistanceMismatches = append(diff.DistanceMismatches, i)
+			continue
+		}
+
+		d := math.Abs(a.MP[i] - b.MP[i])
+		if d > profileTolerance*math.Max(1, math.Abs(a.MP[i])) {
+			diff.DistanceMismatches = append(diff.DistanceMismatches, i)
+		}
+		diff.MaxAbsDiff = math.Max(diff.MaxAbsDiff, d)
+		sum += d
+		compared++
+	}
+	if compared > 0 {
+		diff.MeanAbsDiff = sum / float64(compared)
+	}
+
+	return diff, nil
+}
+
+// compareMP compares the session's matrix profile against the exact profile of
+// the same series, for example to check whether an approximate profile computed
+// under a time budget is good enough
+func compareMP(c *gin.Context) {
+	start := time.Now()
+	endpoint := "/api/v1/compare"
+	method := "GET"
+	session := sessions.Default(c)
+	buildCORSHeaders(c)
+
+	v := fetchMPCache(session)
+	var mp matrixprofile.MatrixProfile
+	if v == nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{
+			Error:        errors.New("matrix profile is not initialized to compare against"),
+			CacheExpired: true,
+		})
+		return
+	} else {
+		mp = v.(matrixprofile.MatrixProfile)
+	}
+
+	exact, _, _, err := computeCachedMP(profileKey(mp.A, mp.M), mp.A, mp.M, "compare")
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	diff, err := compareProfiles(mp, *exact)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	requestTotal.WithLabelValues(method, endpoint, "200").Inc()
+	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+	c.JSON(200, diff)
+}
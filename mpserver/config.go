@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Config is the effective runtime configuration of the server after environment
+// overrides have been applied
+type Config struct {
+	Port              string   `json:"port"`
+	RedisURL          string   `json:"redis_url"`
+	RetentionPeriod   int      `json:"retention_period_s"`
+	MaxRedisBlobSize  int      `json:"max_redis_blob_size"`
+	MPConcurrency     int      `json:"mp_concurrency"`
+	ExclusionFraction float64  `json:"exclusion_fraction"`
+	RateLimit         float64  `json:"rate_limit"`
+	RateLimitBurst    int      `json:"rate_limit_burst"`
+	MaxCachedProfiles int      `json:"max_cached_profiles"`
+	MaxCachedBytes    int      `json:"max_cached_profile_bytes"`
+	WarmupSource      string   `json:"warmup_source"`
+	DataPath          string   `json:"data_path"`
+	DatasetPath       string   `json:"dataset_path,omitempty"`
+	DataSources       []string `json:"data_sources"`
+	PrometheusURL     string   `json:"prometheus_url,omitempty"`
+	StompPairCostNs   float64  `json:"stomp_pair_cost_ns"`
+}
+
+// redactURL replaces any credentials in an address with a placeholder. Addresses
+// without a scheme, like host:port, are returned as is unless they contain an @.
+func redactURL(addr string) string {
+	if u, err := url.Parse(addr); err == nil && u.User != nil {
+		u.User = url.User("REDACTED")
+		return u.String()
+	}
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		return "REDACTED" + addr[i:]
+	}
+	return addr
+}
+
+func getConfig(c *gin.Context) {
+	start := time.Now()
+	endpoint := "/api/v1/config"
+	method := "GET"
+	buildCORSHeaders(c)
+
+	sources := []string{"file"}
+	for prefix := range dataSources {
+		sources = append(sources, strings.TrimSuffix(prefix, ":"))
+	}
+	sort.Strings(sources)
+
+	config := Config{
+		Port:              port,
+		RedisURL:          redactURL(redisURL),
+		RetentionPeriod:   retentionPeriod,
+		MaxRedisBlobSize:  maxRedisBlobSize,
+		MPConcurrency:     mpConcurrency,
+		ExclusionFraction: exclusionFraction,
+		RateLimit:         rateLimitRate,
+		RateLimitBurst:    rateLimitBurst,
+		MaxCachedProfiles: maxCachedProfiles,
+		MaxCachedBytes:    maxCachedProfileBytes,
+		WarmupSource:      warmupSource,
+		DataPath:          dataPath,
+		DatasetPath:       datasetPath,
+		DataSources:       sources,
+		PrometheusURL:     redactURL(prometheusURL),
+		StompPairCostNs:   stompPairCostNs,
+	}
+
+	requestTotal.WithLabelValues(method, endpoint, "200").Inc()
+	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+	c.JSON(200, config)
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,11 +16,56 @@ import (
 
 var dataPath = "./data"
 
+// prometheusPrefix marks a source name as a PromQL query for the prometheus source
+const prometheusPrefix = "prometheus:"
+
+// datasetPrefix marks a source name as one of the datasets preloaded at startup
+const datasetPrefix = "dataset:"
+
 type Data struct {
-	Data []float64 `json:"data"`
+	Data       []float64 `json:"data"`
+	Timestamps []float64 `json:"timestamps,omitempty"`
+}
+
+// dataSource provides input series by name
+type dataSource interface {
+	fetch(name string) (Data, error)
+}
+
+// dataSources maps a source name prefix to the data source that handles it. Names
+// without a registered prefix are read from json files in dataPath.
+var dataSources = map[string]dataSource{}
+
+// fetchData retrieves the series for the source name, dispatching to a registered
+// data source if the name has a matching prefix
+func fetchData(source string) (Data, error) {
+	for prefix, ds := range dataSources {
+		if strings.HasPrefix(source, prefix) {
+			return ds.fetch(strings.TrimPrefix(source, prefix))
+		}
+	}
+	return fetchFile(source)
 }
 
-func fetchData(filename string) (Data, error) {
+// sourceLabel returns a bounded cardinality metric label for a source name that
+// was fetched successfully. Datasets keep their full name since they are a fixed
+// set loaded at startup. Other sources handled by a registered data source are
+// labeled by their prefix since the rest of the name is an arbitrary query. File
+// names are cleaned so that different spellings of the same file, such as "demo"
+// and "./demo", share a label.
+func sourceLabel(source string) string {
+	if strings.HasPrefix(source, datasetPrefix) {
+		return source
+	}
+	for prefix := range dataSources {
+		if strings.HasPrefix(source, prefix) {
+			return strings.TrimSuffix(prefix, ":")
+		}
+	}
+	return filepath.Clean(source)
+}
+
+func fetchFile(filename string) (Data, error) {
 	jsonFile, err := os.Open(filepath.Join(dataPath, filename+".json"))
 	if err != nil {
 		return Data{}, err
@@ -36,6 +84,162 @@ func fetchData(filename string) (Data, error) {
 	return data, nil
 }
 
+// noDetrend is the detrend mode recorded when the series is left unchanged
+const noDetrend = "none"
+
+// Detrend records the preprocessing applied to a series before its matrix profile
+// is computed so that results can be interpreted against the original data.
+// Dropped is the number of samples the preprocessed series is shorter than the
+// original.
+type Detrend struct {
+	Mode      string  `json:"mode"`
+	Slope     float64 `json:"slope,omitempty"`
+	Intercept float64 `json:"intercept,omitempty"`
+	Dropped   int     `json:"dropped,omitempty"`
+}
+
+// detrend removes a global trend from the series. Supported modes are "linear",
+// which subtracts the least squares best fit line, and "diff" (or "derivative"),
+// which takes the first difference. An empty mode returns the series unchanged.
+//
+// The differenced series is one sample shorter than the original, with sample i
+// holding data[i+1]-data[i]. Indices stay aligned to the original series, so a
+// motif or discord at index i with window m describes the change across original
+// samples i through i+m.
+func detrend(data []float64, mode string) ([]float64, Detrend, error) {
+	switch mode {
+	case "":
+		return data, Detrend{Mode: noDetrend}, nil
+	case "linear":
+		slope, intercept := linearFit(data)
+		ddata := make([]float64, len(data))
+		for i, d := range data {
+			ddata[i] = d - (slope*float64(i) + intercept)
+		}
+		return ddata, Detrend{Mode: mode, Slope: slope, Intercept: intercept}, nil
+	case "diff", "derivative":
+		if len(data) < 2 {
+			return nil, Detrend{}, errors.New("series must have at least 2 points to difference")
+		}
+		ddata := make([]float64, len(data)-1)
+		for i := range ddata {
+			ddata[i] = data[i+1] - data[i]
+		}
+		return ddata, Detrend{Mode: "diff", Dropped: 1}, nil
+	default:
+		return nil, Detrend{}, errors.New("invalid detrend mode " + mode)
+	}
+}
+
+// linearFit returns the slope and intercept of the least squares line through the
+// series using the sample index as the x coordinate
+func linearFit(data []float64) (float64, float64) {
+	n := float64(len(data))
+	var sumX, sumY, sumXY, sumXX float64
+	for i, d := range data {
+		x := float64(i)
+		sumX += x
+		sumY += d
+		sumXY += x * d
+		sumXX += x * x
+	}
+
+	denom := n*sumXX - sumX*sumX
+	if denom == 0 {
+		if n == 0 {
+			return 0, 0
+		}
+		return 0, sumY / n
+	}
+	slope := (n*sumXY - sumX*sumY) / denom
+	return slope, (sumY - slope*sumX) / n
+}
+
+// LogTransform records the log transform applied to a series. Each value v was
+// replaced by log(v+Offset) in the given base.
+type LogTransform struct {
+	Base   float64 `json:"base"`
+	Offset float64 `json:"offset"`
+}
+
+// logTransform takes the logarithm of the series in the given base. Non-positive
+// values have no logarithm, so if the series contains any an error is returned
+// unless shift is set. With shift the whole series is offset by 1-min(data) so
+// that its smallest value maps to 0.
+func logTransform(data []float64, base float64, shift bool) ([]float64, LogTransform, error) {
+	if base <= 0 || base == 1 {
+		return nil, LogTransform{}, errors.New("log base must be positive and not equal to 1")
+	}
+
+	var offset float64
+	for _, d := range data {
+		if d > 0 {
+			continue
+		}
+		if !shift {
+			return nil, LogTransform{}, errors.New("series contains non-positive values, enable shifting to log transform it")
+		}
+		if 1-d > offset {
+			offset = 1 - d
+		}
+	}
+
+	ldata := make([]float64, len(data))
+	logBase := math.Log(base)
+	for i, d := range data {
+		ldata[i] = math.Log(d+offset) / logBase
+	}
+	return ldata, LogTransform{Base: base, Offset: offset}, nil
+}
+
+// resample interpolates irregularly sampled values onto a uniform grid starting at
+// the first timestamp with the given interval. Timestamps must be in ascending
+// order and the grid timestamps are returned so indices can be mapped back to
+// time. Supported modes are "linear" interpolation and "previous", which holds the
+// last observed value. An interval coarser than the sampling rate of the data will
+// alias any variation faster than twice the interval rather than averaging it out.
+func resample(ts, vals []float64, interval float64, mode string) ([]float64, []float64, error) {
+	if len(ts) != len(vals) {
+		return nil, nil, errors.New("timestamps and values must be the same length")
+	}
+	if len(ts) == 0 {
+		return nil, nil, errors.New("no values to resample")
+	}
+	if !(interval > 0) {
+		return nil, nil, errors.New("resample interval must be positive")
+	}
+	if mode != "linear" && mode != "previous" {
+		return nil, nil, errors.New("invalid interpolation mode " + mode)
+	}
+	for i := 1; i < len(ts); i++ {
+		if ts[i] < ts[i-1] {
+			return nil, nil, errors.New("timestamps must be in ascending order")
+		}
+	}
+
+	n := int((ts[len(ts)-1]-ts[0])/interval) + 1
+	grid := make([]float64, n)
+	rvals := make([]float64, n)
+
+	var j int
+	for i := range grid {
+		t := ts[0] + float64(i)*interval
+		for j < len(ts)-1 && ts[j+1] <= t {
+			j++
+		}
+
+		grid[i] = t
+		if mode == "previous" || j == len(ts)-1 || ts[j+1] == ts[j] {
+			rvals[i] = vals[j]
+			continue
+		}
+		frac := (t - ts[j]) / (ts[j+1] - ts[j])
+		rvals[i] = vals[j] + frac*(vals[j+1]-vals[j])
+	}
+
+	return grid, rvals, nil
+}
+
 // smooth performs a non causal averaging of neighboring data points
 func smooth(data []float64, m int) []float64 {
 	leftSpan := m / 2
@@ -66,12 +270,50 @@ func smooth(data []float64, m int) []float64 {
 	return sdata
 }
 
+// resampleData puts a fetched series onto a uniform grid with resample unless
+// interval is 0, in which case it is returned unchanged. Only sources that
+// provide timestamps, such as files with a timestamps field, can be resampled.
+func resampleData(data Data, interval float64, mode string) (Data, error) {
+	if interval == 0 {
+		return data, nil
+	}
+	if data.Timestamps == nil {
+		return Data{}, errors.New("source has no timestamps to resample")
+	}
+	grid, vals, err := resample(data.Timestamps, data.Data, interval, mode)
+	if err != nil {
+		return Data{}, err
+	}
+	return Data{Data: vals, Timestamps: grid}, nil
+}
+
+// fetchRequestData fetches the series named by the source query parameter and
+// resamples it if an interval in seconds is given. The interpolation mode
+// defaults to linear.
+func fetchRequestData(c *gin.Context) (Data, error) {
+	data, err := fetchData(c.Query("source"))
+	if err != nil {
+		return Data{}, err
+	}
+
+	var interval float64
+	if v := c.Query("interval"); v != "" {
+		interval, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return Data{}, err
+		}
+	}
+	return resampleData(data, interval, c.DefaultQuery("mode", "linear"))
+}
+
+// getData returns the values of a series. Use getDataWithTimestamps for the
+// timestamps of a resampled series.
 func getData(c *gin.Context) {
 	start := time.Now()
 	endpoint := "/api/v1/data"
 	method := "GET"
 
-	data, err := fetchData(c.Query("source"))
+	data, err := fetchRequestData(c)
 	if err != nil {
 		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
 		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
@@ -86,6 +328,28 @@ func getData(c *gin.Context) {
 	c.JSON(200, data.Data)
 }
 
+// getDataWithTimestamps returns a series along with its timestamps, if its source
+// has any, so that profile indices can be mapped back to time
+func getDataWithTimestamps(c *gin.Context) {
+	start := time.Now()
+	endpoint := "/api/v2/data"
+	method := "GET"
+
+	data, err := fetchRequestData(c)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	buildCORSHeaders(c)
+
+	requestTotal.WithLabelValues(method, endpoint, "200").Inc()
+	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+	c.JSON(200, data)
+}
+
 func getSources(c *gin.Context) {
 	start := time.Now()
 	endpoint := "/api/v1/sources"
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSourceLabel(t *testing.T) {
+	defer func(orig map[string]dataSource) { dataSources = orig }(dataSources)
+	dataSources = map[string]dataSource{
+		prometheusPrefix: &prometheusSource{},
+		datasetPrefix:    &datasetSource{},
+	}
+
+	testData := []struct {
+		source   string
+		expected string
+	}{
+		{"demo", "demo"},
+		{"./demo", "demo"},
+		{"sub/../demo", "demo"},
+		{"dataset:ecg", "dataset:ecg"},
+		{"dataset:power", "dataset:power"},
+		{"prometheus:rate(http_requests_total[5m])", "prometheus"},
+	}
+
+	for _, d := range testData {
+		if label := sourceLabel(d.source); label != d.expected {
+			t.Errorf("expected label %s for %s but got %s", d.expected, d.source, label)
+		}
+	}
+}
+
+func TestResample(t *testing.T) {
+	testData := []struct {
+		ts           []float64
+		vals         []float64
+		interval     float64
+		mode         string
+		expectedGrid []float64
+		expectedVals []float64
+	}{
+		// already uniform
+		{[]float64{0, 1, 2}, []float64{1, 2, 3}, 1, "linear", []float64{0, 1, 2}, []float64{1, 2, 3}},
+		{[]float64{0, 1, 2}, []float64{1, 2, 3}, 1, "previous", []float64{0, 1, 2}, []float64{1, 2, 3}},
+		// a gap is interpolated across or held at the last value
+		{[]float64{0, 1, 4, 5}, []float64{0, 1, 4, 2}, 1, "linear", []float64{0, 1, 2, 3, 4, 5}, []float64{0, 1, 2, 3, 4, 2}},
+		{[]float64{0, 1, 4, 5}, []float64{0, 1, 4, 2}, 1, "previous", []float64{0, 1, 2, 3, 4, 5}, []float64{0, 1, 1, 1, 4, 2}},
+		// irregular samples onto a finer grid
+		{[]float64{10, 10.5, 12}, []float64{2, 4, 1}, 0.5, "linear", []float64{10, 10.5, 11, 11.5, 12}, []float64{2, 4, 3, 2, 1}},
+		{[]float64{10, 10.5, 12}, []float64{2, 4, 1}, 0.5, "previous", []float64{10, 10.5, 11, 11.5, 12}, []float64{2, 4, 4, 4, 1}},
+		// a coarser grid picks values rather than averaging them
+		{[]float64{0, 1, 2, 3, 4}, []float64{0, 5, 0, 5, 0}, 2, "linear", []float64{0, 2, 4}, []float64{0, 0, 0}},
+		// the grid stops at the last timestamp it does not pass
+		{[]float64{0, 2.5}, []float64{0, 5}, 1, "linear", []float64{0, 1, 2}, []float64{0, 2, 4}},
+		// repeated timestamps take the later value
+		{[]float64{0, 1, 1, 2}, []float64{0, 1, 3, 3}, 1, "linear", []float64{0, 1, 2}, []float64{0, 3, 3}},
+		{[]float64{5}, []float64{7}, 1, "previous", []float64{5}, []float64{7}},
+	}
+
+	for _, d := range testData {
+		grid, vals, err := resample(d.ts, d.vals, d.interval, d.mode)
+		if err != nil {
+			t.Errorf("unexpected error resampling %v with %s: %v", d.ts, d.mode, err)
+			continue
+		}
+		if len(grid) != len(d.expectedGrid) || len(vals) != len(d.expectedVals) {
+			t.Errorf("expected grid %v and values %v for %v with %s but got %v and %v", d.expectedGrid, d.expectedVals, d.ts, d.mode, grid, vals)
+			continue
+		}
+		for i := range grid {
+			if math.Abs(grid[i]-d.expectedGrid[i]) > 1e-9 || math.Abs(vals[i]-d.expectedVals[i]) > 1e-9 {
+				t.Errorf("expected grid %v and values %v for %v with %s but got %v and %v", d.expectedGrid, d.expectedVals, d.ts, d.mode, grid, vals)
+				break
+			}
+		}
+	}
+}
+
+func TestResampleInvalid(t *testing.T) {
+	testData := []struct {
+		ts       []float64
+		vals     []float64
+		interval float64
+		mode     string
+	}{
+		// unsorted timestamps
+		{[]float64{0, 2, 1}, []float64{1, 2, 3}, 1, "linear"},
+		{[]float64{3, 2, 1}, []float64{1, 2, 3}, 1, "previous"},
+		{[]float64{0, 1}, []float64{1}, 1, "linear"},
+		{[]float64{}, []float64{}, 1, "linear"},
+		{[]float64{0, 1}, []float64{1, 2}, 0, "linear"},
+		{[]float64{0, 1}, []float64{1, 2}, -1, "linear"},
+		{[]float64{0, 1}, []float64{1, 2}, math.NaN(), "linear"},
+		{[]float64{0, 1}, []float64{1, 2}, 1, "cubic"},
+	}
+
+	for _, d := range testData {
+		if _, _, err := resample(d.ts, d.vals, d.interval, d.mode); err == nil {
+			t.Errorf("expected an error resampling %v, %v with interval %f and mode %s", d.ts, d.vals, d.interval, d.mode)
+		}
+	}
+}
+
+func TestResampleData(t *testing.T) {
+	data := Data{Data: []float64{1, 2, 3}}
+	if got, err := resampleData(data, 0, "linear"); err != nil || len(got.Data) != 3 {
+		t.Errorf("expected the series unchanged without an interval but got %v, %v", got, err)
+	}
+	if _, err := resampleData(data, 1, "linear"); err == nil {
+		t.Error("expected an error resampling a source without timestamps")
+	}
+
+	data.Timestamps = []float64{0, 2, 4}
+	got, err := resampleData(data, 1, "linear")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Timestamps) != 5 || len(got.Data) != 5 || got.Data[1] != 1.5 {
+		t.Errorf("expected the file timestamps to be resampled but got %+v", got)
+	}
+}
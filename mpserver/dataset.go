@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var datasetPath = "" // override with DATASET_PATH environment variable. Empty disables preloaded datasets
+
+var errUnknownDataset = errors.New("unknown dataset")
+
+// datasetSource serves the named datasets that were loaded into memory at
+// startup. Profiles computed from them are cached per series and window size by
+// the shared profile cache like any other source.
+type datasetSource struct {
+	data map[string]Data
+}
+
+// DatasetInfo describes a preloaded dataset
+type DatasetInfo struct {
+	Name   string `json:"name"`
+	Length int    `json:"length"`
+}
+
+// initDatasets loads every json file in DATASET_PATH, in the same format as the
+// files in dataPath, and registers them as the dataset source
+func initDatasets() error {
+	if p := os.Getenv("DATASET_PATH"); p != "" {
+		datasetPath = p
+	}
+	if datasetPath == "" {
+		return nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(datasetPath, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	ds := &datasetSource{data: make(map[string]Data, len(files))}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		var data Data
+		if err := json.Unmarshal(b, &data); err != nil {
+			return err
+		}
+		ds.data[strings.TrimSuffix(filepath.Base(f), ".json")] = data
+	}
+
+	dataSources[datasetPrefix] = ds
+	return nil
+}
+
+func (ds *datasetSource) fetch(name string) (Data, error) {
+	data, ok := ds.data[name]
+	if !ok {
+		return Data{}, errUnknownDataset
+	}
+	return data, nil
+}
+
+func getDatasets(c *gin.Context) {
+	start := time.Now()
+	endpoint := "/api/v1/datasets"
+	method := "GET"
+	buildCORSHeaders(c)
+
+	datasets := []DatasetInfo{}
+	if ds, ok := dataSources[datasetPrefix].(*datasetSource); ok {
+		for name, data := range ds.data {
+			datasets = append(datasets, DatasetInfo{Name: name, Length: len(data.Data)})
+		}
+	}
+	sort.Slice(datasets, func(i, j int) bool { return datasets[i].Name < datasets[j].Name })
+
+	requestTotal.WithLabelValues(method, endpoint, "200").Inc()
+	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+	c.JSON(200, datasets)
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"math"
+	"sort"
 	"strconv"
 	"time"
 
@@ -10,9 +13,133 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// Discord holds the discords found along with the number that were requested.
+// Fewer discords than requested are returned when the exclusion zones of the
+// discords found cover the rest of the matrix profile.
 type Discord struct {
-	Groups []int       `json:"groups"`
-	Series [][]float64 `json:"series"`
+	M         int         `json:"m"`
+	Algorithm string      `json:"algorithm"`
+	Groups    []int       `json:"groups"`
+	Series    [][]float64 `json:"series"`
+	Requested int         `json:"requested"`
+
+	// Approximate is set when the profile was computed with STAMP under a time
+	// budget. Distances are then upper bounds, so discords may be spurious.
+	Approximate bool `json:"approximate"`
+
+	// Page is the slice of the discords found that was returned
+	Page
+}
+
+// findDiscords returns up to k indices of the subsequences with the largest matrix
+// profile distances, in descending order of distance. The first and last margin
+// subsequences are never reported since edge subsequences have fewer neighbors and
+// tend to have spuriously large distances. After each discord is chosen the
+// subsequences within exzone of it are no longer considered. If the profile runs
+// out of candidates before k discords are found the shorter list is returned
+// without an error.
+func findDiscords(mp matrixprofile.MatrixProfile, k, exzone, margin int) ([]int, error) {
+	if k < 1 {
+		return nil, errors.New("number of discords must be at least 1")
+	}
+	if margin < 0 {
+		return nil, errors.New("discord margin must not be negative")
+	}
+
+	// excluded positions are marked as NaN in a copy of the profile
+	mpCurrent := make([]float64, len(mp.MP))
+	copy(mpCurrent, mp.MP)
+	for i := 0; i < margin && i < len(mpCurrent); i++ {
+		mpCurrent[i] = math.NaN()
+		mpCurrent[len(mpCurrent)-1-i] = math.NaN()
+	}
+
+	discords := make([]int, 0, k)
+	for len(discords) < k {
+		_, maxIdx := maxIgnoreNaN(mpCurrent)
+		if maxIdx < 0 {
+			break
+		}
+
+		discords = append(discords, maxIdx)
+		for i := maxIdx - exzone; i <= maxIdx+exzone; i++ {
+			if i >= 0 && i < len(mpCurrent) {
+				mpCurrent[i] = math.NaN()
+			}
+		}
+	}
+
+	return discords, nil
+}
+
+type DiscordRegions struct {
+	M         int      `json:"m"`
+	Algorithm string   `json:"algorithm"`
+	Threshold float64  `json:"threshold"`
+	Regions   [][2]int `json:"regions"`
+}
+
+// discordRegions merges consecutive subsequences with a matrix profile distance
+// above the threshold into contiguous anomalous regions. Each region is returned
+// as the start index of its first subsequence and the exclusive end index of its
+// last subsequence in the series.
+func discordRegions(mp matrixprofile.MatrixProfile, threshold float64) ([][2]int, error) {
+	if math.IsNaN(threshold) || threshold < 0 {
+		return nil, errors.New("discord region threshold must be a non-negative number")
+	}
+
+	regions := make([][2]int, 0)
+	regionStart := -1
+	for i, d := range mp.MP {
+		above := isFinite(d) && d > threshold
+		if above && regionStart < 0 {
+			regionStart = i
+		}
+		if !above && regionStart >= 0 {
+			regions = append(regions, [2]int{regionStart, i - 1 + mp.M})
+			regionStart = -1
+		}
+	}
+	if regionStart >= 0 {
+		regions = append(regions, [2]int{regionStart, len(mp.MP) - 1 + mp.M})
+	}
+
+	return regions, nil
+}
+
+// boundaryArtifactMask flags the positions at either end of the matrix profile
+// that are likely inflated by the edge effect. Subsequences near the boundaries
+// have fewer candidate neighbors, which shows up as a rise in distance towards
+// the edges. Starting from each end and moving inward for up to a window size,
+// positions are flagged until the distance falls to the median of the interior
+// of the profile. NaN and infinite distances at the edges are also flagged.
+func boundaryArtifactMask(mp matrixprofile.MatrixProfile) []bool {
+	n := len(mp.MP)
+	mask := make([]bool, n)
+
+	band := mp.M
+	if band > n/4 {
+		band = n / 4
+	}
+	interior := make([]float64, 0, n)
+	for _, d := range mp.MP[band : n-band] {
+		if isFinite(d) {
+			interior = append(interior, d)
+		}
+	}
+	if len(interior) == 0 {
+		return mask
+	}
+	sort.Float64s(interior)
+	median := interior[len(interior)/2]
+
+	for i := 0; i < band && !(isFinite(mp.MP[i]) && mp.MP[i] <= median); i++ {
+		mask[i] = true
+	}
+	for i := n - 1; i >= n-band && !(isFinite(mp.MP[i]) && mp.MP[i] <= median); i-- {
+		mask[i] = true
+	}
+	return mask
 }
 
 func topKDiscords(c *gin.Context) {
@@ -32,6 +159,14 @@ func topKDiscords(c *gin.Context) {
 		return
 	}
 
+	offset, limit, err := parsePage(c)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
 	v := fetchMPCache(session)
 	var mp matrixprofile.MatrixProfile
 	if v == nil {
@@ -45,21 +180,73 @@ func topKDiscords(c *gin.Context) {
 	} else {
 		mp = v.(matrixprofile.MatrixProfile)
 	}
-	discords, err := mp.TopKDiscords(k, mp.M/2)
+	// skip edge subsequences, by default as far as the exclusion zone reaches
+	margin := exclusionZone(mp.M)
+	if s, ok := c.GetQuery("margin"); ok {
+		margin, err = strconv.Atoi(s)
+		if err != nil {
+			requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+			serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+			c.JSON(500, RespError{Error: err})
+			return
+		}
+	}
+
+	// positions affected by the edge effect can be left out of the ranking in
+	// addition to the margin
+	maskBoundary, err := strconv.ParseBool(c.DefaultQuery("mask_boundary", "false"))
 	if err != nil {
 		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
 		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
-		c.JSON(500, RespError{
-			Error: errors.New("failed to compute discords"),
-		})
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+	ranked := mp
+	if maskBoundary {
+		ranked.MP = make([]float64, len(mp.MP))
+		copy(ranked.MP, mp.MP)
+		for i, masked := range boundaryArtifactMask(mp) {
+			if masked {
+				ranked.MP[i] = math.NaN()
+			}
+		}
+	}
+
+	discords, err := findDiscords(ranked, k, exclusionZone(mp.M), margin)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	lo, hi, page, err := paginate(len(discords), offset, limit)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
 		return
 	}
 
 	var discord Discord
-	discord.Groups = discords
-	discord.Series = make([][]float64, len(discords))
+	discord.M = mp.M
+	computeParams := fetchComputeParams(session)
+	discord.Algorithm = computeParams.Algorithm
+	discord.Approximate = computeParams.Algorithm == stampAlgorithm
+	discord.Groups = discords[lo:hi]
+	discord.Requested = k
+	discord.Page = page
+	discord.Series = make([][]float64, len(discord.Groups))
 	for i, didx := range discord.Groups {
-		discord.Series[i], err = matrixprofile.ZNormalize(mp.A[didx : didx+mp.M])
+		subseq, err := subsequence(mp, didx)
+		if err != nil {
+			requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+			serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+			c.JSON(500, RespError{Error: err})
+			return
+		}
+
+		discord.Series[i], err = matrixprofile.ZNormalize(subseq)
 		if err != nil {
 			requestTotal.WithLabelValues(method, endpoint, "500").Inc()
 			serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
@@ -72,3 +259,148 @@ func topKDiscords(c *gin.Context) {
 	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
 	c.JSON(200, discord)
 }
+
+func getDiscordRegions(c *gin.Context) {
+	start := time.Now()
+	endpoint := "/api/v1/discordregions"
+	method := "GET"
+	session := sessions.Default(c)
+	buildCORSHeaders(c)
+
+	threshold, err := strconv.ParseFloat(c.Query("threshold"), 64)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	v := fetchMPCache(session)
+	var mp matrixprofile.MatrixProfile
+	if v == nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{
+			Error:        errors.New("matrix profile is not initialized to compute discord regions"),
+			CacheExpired: true,
+		})
+		return
+	} else {
+		mp = v.(matrixprofile.MatrixProfile)
+	}
+
+	regions, err := discordRegions(mp, threshold)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	requestTotal.WithLabelValues(method, endpoint, "200").Inc()
+	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+	c.JSON(200, DiscordRegions{
+		M:         mp.M,
+		Algorithm: fetchComputeParams(session).Algorithm,
+		Threshold: threshold,
+		Regions:   regions,
+	})
+}
+
+// Explanation breaks the distance from a subsequence to its nearest neighbor down
+// by position within the window. Contributions sum to the squared distance.
+type Explanation struct {
+	M             int       `json:"m"`
+	Algorithm     string    `json:"algorithm"`
+	Idx           int       `json:"idx"`
+	Neighbor      int       `json:"neighbor"`
+	Distance      float64   `json:"distance"`
+	Contributions []float64 `json:"contributions"`
+}
+
+// discordExplanation returns the squared difference at each position between the
+// z-normalized subsequence at idx and its nearest neighbor, which shows which
+// samples make the subsequence anomalous
+func discordExplanation(mp matrixprofile.MatrixProfile, idx int) (Explanation, error) {
+	if idx < 0 || idx >= len(mp.Idx) {
+		return Explanation{}, fmt.Errorf("index %d is out of range [0, %d)", idx, len(mp.Idx))
+	}
+	neighbor := mp.Idx[idx]
+	if !isFinite(mp.MP[idx]) || neighbor < 0 || neighbor >= len(mp.Idx) {
+		return Explanation{}, fmt.Errorf("subsequence %d has no nearest neighbor", idx)
+	}
+
+	q, err := subsequence(mp, idx)
+	if err != nil {
+		return Explanation{}, err
+	}
+	zq, err := matrixprofile.ZNormalize(q)
+	if err != nil {
+		return Explanation{}, err
+	}
+	t, err := subsequence(mp, neighbor)
+	if err != nil {
+		return Explanation{}, err
+	}
+	zt, err := matrixprofile.ZNormalize(t)
+	if err != nil {
+		return Explanation{}, err
+	}
+
+	contributions := make([]float64, len(zq))
+	for i := range zq {
+		contributions[i] = (zq[i] - zt[i]) * (zq[i] - zt[i])
+	}
+
+	return Explanation{
+		Idx:           idx,
+		Neighbor:      neighbor,
+		Distance:      mp.MP[idx],
+		Contributions: contributions,
+	}, nil
+}
+
+func getExplanation(c *gin.Context) {
+	start := time.Now()
+	endpoint := "/api/v1/explain"
+	method := "GET"
+	session := sessions.Default(c)
+	buildCORSHeaders(c)
+
+	idx, err := strconv.Atoi(c.Query("idx"))
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	v := fetchMPCache(session)
+	var mp matrixprofile.MatrixProfile
+	if v == nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{
+			Error:        errors.New("matrix profile is not initialized to explain discords"),
+			CacheExpired: true,
+		})
+		return
+	} else {
+		mp = v.(matrixprofile.MatrixProfile)
+	}
+
+	explanation, err := discordExplanation(mp, idx)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	explanation.M = mp.M
+	explanation.Algorithm = fetchComputeParams(session).Algorithm
+
+	requestTotal.WithLabelValues(method, endpoint, "200").Inc()
+	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+	c.JSON(200, explanation)
+}
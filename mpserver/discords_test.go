@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/aouyang1/go-matrixprofile/matrixprofile"
+)
+
+func TestFindDiscords(t *testing.T) {
+	testData := []struct {
+		mp       []float64
+		k        int
+		exzone   int
+		margin   int
+		expected []int
+	}{
+		{[]float64{1, 5, 2, 3, 4}, 1, 0, 0, []int{1}},
+		{[]float64{1, 5, 2, 3, 4}, 3, 0, 0, []int{1, 4, 3}},
+		// the exclusion zones of the first two discords cover the tiny profile
+		{[]float64{1, 5, 2, 3, 4}, 3, 2, 0, []int{1, 4}},
+		{[]float64{1, 5, 2, 3, 4}, 10, 1, 0, []int{1, 4}},
+		// the margin removes the edges before the exclusion zones apply
+		{[]float64{6, 5, 2, 3, 7}, 3, 1, 1, []int{1, 3}},
+		{[]float64{6, 5, 2, 3, 7}, 3, 0, 3, []int{}},
+		{[]float64{math.NaN(), 2, math.Inf(1), 1}, 3, 0, 0, []int{1, 3}},
+		{[]float64{math.NaN(), math.NaN()}, 2, 0, 0, []int{}},
+		{[]float64{}, 2, 0, 0, []int{}},
+	}
+
+	for _, d := range testData {
+		discords, err := findDiscords(matrixprofile.MatrixProfile{MP: d.mp}, d.k, d.exzone, d.margin)
+		if err != nil {
+			t.Fatalf("unexpected error for %v: %v", d.mp, err)
+		}
+		if len(discords) != len(d.expected) {
+			t.Errorf("expected discords %v for %v with k=%d but got %v", d.expected, d.mp, d.k, discords)
+			continue
+		}
+		for i := range discords {
+			if discords[i] != d.expected[i] {
+				t.Errorf("expected discords %v for %v with k=%d but got %v", d.expected, d.mp, d.k, discords)
+				break
+			}
+		}
+	}
+}
+
+func TestFindDiscordsInvalid(t *testing.T) {
+	mp := matrixprofile.MatrixProfile{MP: []float64{1, 2, 3}}
+	if _, err := findDiscords(mp, 0, 0, 0); err == nil {
+		t.Error("expected an error for k=0")
+	}
+	if _, err := findDiscords(mp, 1, 0, -1); err == nil {
+		t.Error("expected an error for a negative margin")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/aouyang1/go-matrixprofile/matrixprofile"
+)
+
+// movMeanStd computes the mean and standard deviation of every subsequence of
+// length m in the series
+func movMeanStd(a []float64, m int) ([]float64, []float64) {
+	n := len(a) - m + 1
+	mean := make([]float64, n)
+	std := make([]float64, n)
+
+	var sum, sumSq float64
+	for i, v := range a {
+		sum += v
+		sumSq += v * v
+		if i >= m {
+			sum -= a[i-m]
+			sumSq -= a[i-m] * a[i-m]
+		}
+		if i >= m-1 {
+			mu := sum / float64(m)
+			mean[i-m+1] = mu
+			std[i-m+1] = math.Sqrt(math.Max(sumSq/float64(m)-mu*mu, 0))
+		}
+	}
+	return mean, std
+}
+
+// distanceProfile computes the z-normalized euclidean distance from the subsequence
+// at idx to every subsequence of the matrix profile's series. Subsequences with no
+// variance have a NaN distance. An error is returned if the query subsequence
+// itself has no variance.
+func distanceProfile(mp matrixprofile.MatrixProfile, idx int) ([]float64, error) {
+	if _, err := subsequence(mp, idx); err != nil {
+		return nil, err
+	}
+
+	mean, std := movMeanStd(mp.A, mp.M)
+	if std[idx] == 0 {
+		return nil, fmt.Errorf("subsequence %d has no variance to compute distances from", idx)
+	}
+
+	dp := make([]float64, len(mean))
+	fillDistanceProfile(dp, mp.A, mp.M, mean, std, idx)
+	return dp, nil
+}
+
+// dot returns the dot product of two equal length slices
+func dot(x, y []float64) float64 {
+	var sum float64
+	for i, v := range x {
+		sum += v * y[i]
+	}
+	return sum
+}
+
+// corrDistance converts the dot product qt of two subsequences of length m into
+// their z-normalized euclidean distance, given the product of their means and the
+// product of their standard deviations. Neither standard deviation may be zero.
+func corrDistance(qt, meanProd, stdProd float64, m int) float64 {
+	fm := float64(m)
+	corr := (qt - fm*meanProd) / (fm * stdProd)
+	return math.Sqrt(math.Max(2*fm*(1-corr), 0))
+}
+
+// fillDistanceProfile writes the distance from the subsequence at idx to every
+// subsequence of a into dp, given the moving mean and standard deviation of a.
+// Each distance takes a dot product over the window, so a full profile costs
+// O(n*m). The subsequence at idx must have a non zero standard deviation.
+func fillDistanceProfile(dp, a []float64, m int, mean, std []float64, idx int) {
+	q := a[idx : idx+m]
+	for j := range dp {
+		if std[j] == 0 {
+			dp[j] = math.NaN()
+			continue
+		}
+
+		var qt float64
+		for k, v := range q {
+			qt += v * a[j+k]
+		}
+		dp[j] = corrDistance(qt, mean[idx]*mean[j], std[idx]*std[j], m)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/aouyang1/go-matrixprofile/matrixprofile"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// calibrationLength and calibrationWindow size the series used to time STOMP
+	// at startup. It is large enough to dominate setup costs while still taking
+	// only tens of milliseconds.
+	calibrationLength = 2000
+	calibrationWindow = 32
+)
+
+// stompPairCostNs is the measured single threaded cost in nanoseconds of
+// comparing one pair of subsequences, set by initStompEstimate
+var stompPairCostNs float64
+
+// initStompEstimate times a single threaded STOMP over a random walk to calibrate
+// estimateStompDuration for this machine
+func initStompEstimate() error {
+	r := rand.New(rand.NewSource(1))
+	data := make([]float64, calibrationLength)
+	for i := 1; i < len(data); i++ {
+		data[i] = data[i-1] + r.NormFloat64()
+	}
+
+	mp, err := matrixprofile.New(data, nil, calibrationWindow)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	if err := mp.Stomp(1); err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+
+	n := calibrationLength - calibrationWindow + 1
+	stompPairCostNs = float64(elapsed.Nanoseconds()) / float64(n*n)
+	return nil
+}
+
+// estimateStompDuration predicts how long STOMP takes for a series of length n
+// with window m. STOMP compares every pair of subsequences so the estimate grows
+// quadratically with the number of subsequences and shrinks with the concurrency
+// up to the number of CPUs. The estimate ignores contention from other requests
+// and is usually within a factor of two of the actual time.
+func estimateStompDuration(n, m, concurrency int) time.Duration {
+	subseqs := n - m + 1
+	if subseqs < 1 {
+		return 0
+	}
+
+	workers := concurrency
+	if cpus := runtime.NumCPU(); workers > cpus {
+		workers = cpus
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	pairs := float64(subseqs) * float64(subseqs)
+	return time.Duration(stompPairCostNs * pairs / float64(workers))
+}
+
+// Estimate is the predicted compute time for a series of length N with window M
+type Estimate struct {
+	N           int     `json:"n"`
+	M           int     `json:"m"`
+	Concurrency int     `json:"concurrency"`
+	DurationMs  float64 `json:"duration_ms"`
+}
+
+func getEstimate(c *gin.Context) {
+	start := time.Now()
+	endpoint := "/api/v1/estimate"
+	method := "GET"
+	buildCORSHeaders(c)
+
+	n, err := strconv.Atoi(c.Query("n"))
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	m, err := strconv.Atoi(c.Query("m"))
+	if err == nil && (m < 2 || m > n) {
+		err = errors.New("m must be between 2 and n")
+	}
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	// defaults to the concurrency the server computes with
+	concurrency, err := strconv.Atoi(c.DefaultQuery("concurrency", strconv.Itoa(mpConcurrency)))
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	d := estimateStompDuration(n, m, concurrency)
+
+	requestTotal.WithLabelValues(method, endpoint, "200").Inc()
+	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+	c.JSON(200, Estimate{
+		N:           n,
+		M:           m,
+		Concurrency: concurrency,
+		DurationMs:  d.Seconds() * 1000,
+	})
+}
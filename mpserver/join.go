@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/aouyang1/go-matrixprofile/matrixprofile"
+	"github.com/gin-gonic/gin"
+)
+
+// defaultJoinDiscords is the number of anomalies returned from a join when k is
+// not provided
+const defaultJoinDiscords = 3
+
+// Join is the result of an AB-join. MP and Idx have an entry for each subsequence
+// of A, holding the distance to and index of its nearest neighbor in B. Discords
+// are the subsequences of A that are furthest from anything in B. When A is
+// joined against several reference series, Refs holds which reference each
+// nearest neighbor was found in and Idx is the index within that reference.
+type Join struct {
+	M         int        `json:"m"`
+	Algorithm string     `json:"algorithm"`
+	MP        []*float64 `json:"mp"`
+	Idx       []int      `json:"idx"`
+	Refs      []int      `json:"refs,omitempty"`
+	Discords  []int      `json:"discords"`
+}
+
+// joinMany scores each subsequence of a by its distance to the nearest
+// subsequence across all of the reference series, returning the distance, the
+// index within the matching reference and which reference matched. References
+// are joined one at a time and only the running minimum is kept, so memory grows
+// with the length of a and the largest single reference rather than with the
+// number of references.
+func joinMany(a []float64, refs [][]float64, m int) ([]float64, []int, []int, error) {
+	if len(refs) == 0 {
+		return nil, nil, nil, errors.New("at least one reference series is required")
+	}
+	// checked before sizing the outputs from m so that a negative window can't
+	// request an enormous allocation
+	if m < 2 {
+		return nil, nil, nil, errors.New("window size must be at least 2")
+	}
+	if len(a) < m {
+		return nil, nil, nil, fmt.Errorf("series a must be at least the window size of %d", m)
+	}
+
+	n := len(a) - m + 1
+	dist := make([]float64, n)
+	idx := make([]int, n)
+	ref := make([]int, n)
+	for i := range dist {
+		dist[i] = math.Inf(1)
+		idx[i] = -1
+		ref[i] = -1
+	}
+
+	for r, b := range refs {
+		if len(b) < m {
+			return nil, nil, nil, fmt.Errorf("reference series %d must be at least the window size of %d", r, m)
+		}
+
+		// the matrix profile is computed for each subsequence of the second series
+		// against the first, so the reference is passed first to get a profile
+		// over a
+		mp, err := matrixprofile.New(b, a, m)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if err = mp.Stomp(mpConcurrency); err != nil {
+			return nil, nil, nil, err
+		}
+
+		for i, d := range mp.MP {
+			if isFinite(d) && d < dist[i] {
+				dist[i] = d
+				idx[i] = mp.Idx[i]
+				ref[i] = r
+			}
+		}
+	}
+
+	return dist, idx, ref, nil
+}
+
+func joinMP(c *gin.Context) {
+	start := time.Now()
+	endpoint := "/api/v1/join"
+	method := "POST"
+	buildCORSHeaders(c)
+
+	// a is joined against either a single series b or a list of references
+	params := struct {
+		A    []float64   `json:"a"`
+		B    []float64   `json:"b"`
+		Refs [][]float64 `json:"refs"`
+		M    int         `json:"m"`
+		K    int         `json:"k"`
+	}{}
+	if err := c.BindJSON(&params); err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+	if len(params.B) > 0 && len(params.Refs) > 0 {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: errors.New("only one of b or refs can be provided")})
+		return
+	}
+	refs := params.Refs
+	if len(params.B) > 0 {
+		refs = [][]float64{params.B}
+	}
+	k := params.K
+	if k <= 0 {
+		k = defaultJoinDiscords
+	}
+
+	dist, idx, ref, err := joinMany(params.A, refs, params.M)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	discords, err := findDiscords(matrixprofile.MatrixProfile{M: params.M, MP: dist}, k, exclusionZone(params.M), exclusionZone(params.M))
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	join := Join{
+		M:         params.M,
+		Algorithm: stompAlgorithm,
+		MP:        alignToSeries(dist, len(dist)),
+		Idx:       idx,
+		Discords:  discords,
+	}
+	if len(params.Refs) > 0 {
+		join.Refs = ref
+	}
+
+	requestTotal.WithLabelValues(method, endpoint, "200").Inc()
+	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+	c.JSON(200, join)
+}
+
+// Contrast is the contrast profile of a reference series from class A against
+// class B. Each entry is the distance from a subsequence of the reference to its
+// nearest neighbor in class B less the distance to its nearest neighbor in class
+// A, so large positive values mark patterns that recur within class A but do not
+// appear in class B. Idx and Refs locate the nearest neighbor in class B and Top
+// is the subsequence with the largest contrast, or -1 if there is none.
+type Contrast struct {
+	M         int        `json:"m"`
+	Algorithm string     `json:"algorithm"`
+	Contrast  []*float64 `json:"contrast"`
+	Idx       []int      `json:"idx"`
+	Refs      []int      `json:"refs"`
+	Top       int        `json:"top"`
+}
+
+// contrastProfile computes the contrast profile of classA[ref] against classB.
+// The distance within class A is the smaller of the reference's self join and its
+// join with the other instances of class A.
+func contrastProfile(classA, classB [][]float64, ref, m int) ([]float64, []int, []int, error) {
+	if ref < 0 || ref >= len(classA) {
+		return nil, nil, nil, fmt.Errorf("reference %d is out of range [0, %d)", ref, len(classA))
+	}
+	if m < 2 {
+		return nil, nil, nil, errors.New("window size must be at least 2")
+	}
+	a := classA[ref]
+
+	self, _, _, err := computeCachedMP(profileKey(a, m), a, m, "contrast")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	within := make([]float64, len(self.MP))
+	copy(within, self.MP)
+
+	others := make([][]float64, 0, len(classA)-1)
+	others = append(others, classA[:ref]...)
+	others = append(others, classA[ref+1:]...)
+	if len(others) > 0 {
+		dist, _, _, err := joinMany(a, others, m)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for i, d := range dist {
+			if !isFinite(within[i]) || d < within[i] {
+				within[i] = d
+			}
+		}
+	}
+
+	between, idx, refs, err := joinMany(a, classB, m)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	contrast := make([]float64, len(between))
+	for i := range contrast {
+		contrast[i] = between[i] - within[i]
+	}
+	return contrast, idx, refs, nil
+}
+
+func getContrast(c *gin.Context) {
+	start := time.Now()
+	endpoint := "/api/v1/contrast"
+	method := "POST"
+	buildCORSHeaders(c)
+
+	params := struct {
+		A   [][]float64 `json:"a"`
+		B   [][]float64 `json:"b"`
+		M   int         `json:"m"`
+		Ref int         `json:"ref"`
+	}{}
+	if err := c.BindJSON(&params); err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	contrast, idx, refs, err := contrastProfile(params.A, params.B, params.Ref, params.M)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+	_, top := maxIgnoreNaN(contrast)
+
+	requestTotal.WithLabelValues(method, endpoint, "200").Inc()
+	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+	c.JSON(200, Contrast{
+		M:         params.M,
+		Algorithm: stompAlgorithm,
+		Contrast:  alignToSeries(contrast, len(contrast)),
+		Idx:       idx,
+		Refs:      refs,
+		Top:       top,
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/aouyang1/go-matrixprofile/matrixprofile"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// lagAlgorithm is the name reported for lag profiles, which are computed by
+// lagProfile rather than taken from the session's profile
+const lagAlgorithm = "lag"
+
+type LagProfile struct {
+	M         int        `json:"m"`
+	Algorithm string     `json:"algorithm"`
+	Lag       int        `json:"lag"`
+	Profile   []*float64 `json:"profile"`
+}
+
+// lagProfile computes, for each subsequence, the z-normalized euclidean distance
+// to the subsequence lag samples later. This is a join of the series against itself
+// shifted by lag and measures how well the series repeats at that lag over time.
+// The pearson correlation of the two windows is 1-d^2/(2m), so the profile is a
+// windowed, local form of the autocorrelation at a single lag. The last lag
+// subsequences have no shifted partner and, like subsequences with no variance,
+// are NaN.
+func lagProfile(mp matrixprofile.MatrixProfile, lag int) ([]float64, error) {
+	n := len(mp.A) - mp.M + 1
+	if lag < 1 || lag >= n {
+		return nil, fmt.Errorf("lag must be within [1, %d)", n)
+	}
+
+	mean, std := movMeanStd(mp.A, mp.M)
+	profile := make([]float64, n)
+	for i := range profile {
+		j := i + lag
+		if j >= n || std[i] == 0 || std[j] == 0 {
+			profile[i] = math.NaN()
+			continue
+		}
+
+		var qt float64
+		for k := 0; k < mp.M; k++ {
+			qt += mp.A[i+k] * mp.A[j+k]
+		}
+		profile[i] = corrDistance(qt, mean[i]*mean[j], std[i]*std[j], mp.M)
+	}
+
+	return profile, nil
+}
+
+func getLagProfile(c *gin.Context) {
+	start := time.Now()
+	endpoint := "/api/v1/lag"
+	method := "GET"
+	session := sessions.Default(c)
+	buildCORSHeaders(c)
+
+	lag, err := strconv.Atoi(c.Query("l"))
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	v := fetchMPCache(session)
+	var mp matrixprofile.MatrixProfile
+	if v == nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{
+			Error:        errors.New("matrix profile is not initialized to compute a lag profile"),
+			CacheExpired: true,
+		})
+		return
+	} else {
+		mp = v.(matrixprofile.MatrixProfile)
+	}
+
+	profile, err := lagProfile(mp, lag)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	requestTotal.WithLabelValues(method, endpoint, "200").Inc()
+	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+	c.JSON(200, LagProfile{
+		M:         mp.M,
+		Algorithm: lagAlgorithm,
+		Lag:       lag,
+		Profile:   alignToSeries(profile, len(profile)),
+	})
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"math"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/aouyang1/go-matrixprofile/matrixprofile"
@@ -15,11 +20,15 @@ import (
 )
 
 var (
-	mpConcurrency    = 4
-	maxRedisBlobSize = 10 * 1024 * 1024
-	retentionPeriod  = 10 * 60
-	redisURL         = "localhost:6379" // override with REDIS_URL environment variable
-	port             = "8081"           // override with PORT environment variable
+	mpConcurrency     = 4
+	exclusionFraction = 0.5   // trivial match zone for motif and discord discovery as a fraction of m, override with EXCLUSION_FRACTION environment variable
+	logComputeParams  = false // override with LOG_COMPUTE_PARAMS environment variable
+	maxRedisBlobSize  = 10 * 1024 * 1024
+	retentionPeriod   = 10 * 60
+	redisURL          = "localhost:6379" // override with REDIS_URL environment variable
+	port              = "8081"           // override with PORT environment variable
+	rateLimitRate     = 0.0              // requests per second per client, override with RATE_LIMIT environment variable. 0 disables rate limiting
+	rateLimitBurst    = 5                // override with RATE_LIMIT_BURST environment variable
 
 	requestTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -44,6 +53,38 @@ var (
 		},
 		[]string{"command", "status"},
 	)
+	computeTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mpserver_computes_total",
+			Help: "count of matrix profile computations by what triggered them",
+		},
+		[]string{"trigger"},
+	)
+	profileCacheRequestTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mpserver_profile_cache_requests_total",
+			Help: "count of shared matrix profile cache lookups by result",
+		},
+		[]string{"result"},
+	)
+	cacheClearTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mpserver_cache_clears_total",
+			Help: "count of explicit clears of a session's cached matrix profile",
+		},
+	)
+	strongestDiscordDistance = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "mpserver_strongest_discord_distance",
+			Help: "largest matrix profile distance of the most recently calculated profile per source.",
+		},
+		[]string{"source"},
+	)
+)
+
+var errMPTooLarge = fmt.Errorf(
+	"matrix profile is too large to cache, the limit is %d bytes. Try a shorter series",
+	maxRedisBlobSize,
 )
 
 type RespError struct {
@@ -51,10 +92,27 @@ type RespError struct {
 	CacheExpired bool  `json:"cache_expired"`
 }
 
+// MarshalJSON writes the error as its message since error values otherwise
+// encode as an empty object
+func (r RespError) MarshalJSON() ([]byte, error) {
+	resp := struct {
+		Error        string `json:"error"`
+		CacheExpired bool   `json:"cache_expired"`
+	}{CacheExpired: r.CacheExpired}
+	if r.Error != nil {
+		resp.Error = r.Error.Error()
+	}
+	return json.Marshal(resp)
+}
+
 func init() {
 	prometheus.MustRegister(requestTotal)
 	prometheus.MustRegister(serviceRequestDuration)
 	prometheus.MustRegister(redisClientRequestDuration)
+	prometheus.MustRegister(strongestDiscordDistance)
+	prometheus.MustRegister(cacheClearTotal)
+	prometheus.MustRegister(computeTotal)
+	prometheus.MustRegister(profileCacheRequestTotal)
 }
 
 func main() {
@@ -73,14 +131,76 @@ func main() {
 		matrixprofile.MatrixProfile{},
 	)
 
+	if v := os.Getenv("LOG_COMPUTE_PARAMS"); v != "" {
+		logComputeParams, err = strconv.ParseBool(v)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if err := initExclusionFraction(); err != nil {
+		panic(err)
+	}
+
+	if err := initProfileCache(); err != nil {
+		panic(err)
+	}
+
+	if err := initPrometheusSource(); err != nil {
+		panic(err)
+	}
+
+	if err := initDatasets(); err != nil {
+		panic(err)
+	}
+
+	limiter, err := initRateLimiter()
+	if err != nil {
+		panic(err)
+	}
+
+	if err := initStompEstimate(); err != nil {
+		panic(err)
+	}
+
+	// every endpoint that computes over a series or profile is rate limited, only
+	// the ones that list or look up small values are not
 	v1 := r.Group("/api/v1")
 	{
 		v1.GET("/data", getData)
 		v1.GET("/sources", getSources)
-		v1.POST("/calculate", calculateMP)
-		v1.GET("/topkmotifs", topKMotifs)
-		v1.GET("/topkdiscords", topKDiscords)
-		v1.POST("/mp", getMP)
+		v1.GET("/datasets", getDatasets)
+		v1.GET("/windows", rateLimit(limiter), getWindows)
+		v1.GET("/config", getConfig)
+		v1.GET("/estimate", getEstimate)
+		v1.POST("/calculate", rateLimit(limiter), calculateMP)
+		v1.GET("/topkmotifs", rateLimit(limiter), topKMotifs)
+		v1.GET("/motifsaround", rateLimit(limiter), getMotifsAround)
+		v1.GET("/motif.png", rateLimit(limiter), getMotifPNG)
+		v1.GET("/topkdiscords", rateLimit(limiter), topKDiscords)
+		v1.GET("/discordregions", rateLimit(limiter), getDiscordRegions)
+		v1.GET("/explain", rateLimit(limiter), getExplanation)
+		v1.GET("/summary", rateLimit(limiter), getSummary)
+		v1.GET("/histogram", rateLimit(limiter), getHistogram)
+		v1.GET("/chain", rateLimit(limiter), getChain)
+		v1.GET("/segments", rateLimit(limiter), getSegments)
+		v1.GET("/lag", rateLimit(limiter), getLagProfile)
+		v1.GET("/annotations", getAnnotations)
+		v1.POST("/mp", rateLimit(limiter), getMP)
+		v1.DELETE("/mp", deleteMP)
+		v1.POST("/warmup", rateLimit(limiter), warmup)
+		v1.GET("/bundle", rateLimit(limiter), getBundle)
+		v1.GET("/compare", rateLimit(limiter), compareMP)
+		v1.POST("/join", rateLimit(limiter), joinMP)
+		v1.POST("/selfjoin", rateLimit(limiter), selfJoinMP)
+		v1.POST("/contrast", rateLimit(limiter), getContrast)
+		v1.POST("/stream/append", rateLimit(limiter), appendStream)
+	}
+	// v2 holds endpoints whose response shape changed from v1, which keeps the
+	// old shape for existing clients
+	v2 := r.Group("/api/v2")
+	{
+		v2.GET("/data", getDataWithTimestamps)
 	}
 	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
@@ -112,13 +232,70 @@ func initRedis() (redis.Store, error) {
 	return store, nil
 }
 
+// initRateLimiter sets up the rate limiter for the compute endpoints. A nil
+// limiter is returned if rate limiting is disabled.
+func initRateLimiter() (*rateLimiter, error) {
+	if v := os.Getenv("RATE_LIMIT"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, err
+		}
+		rateLimitRate = rate
+	}
+	if v := os.Getenv("RATE_LIMIT_BURST"); v != "" {
+		burst, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		rateLimitBurst = burst
+	}
+
+	if rateLimitRate <= 0 {
+		return nil, nil
+	}
+	return newRateLimiter(rateLimitRate, rateLimitBurst), nil
+}
+
+// initExclusionFraction applies the EXCLUSION_FRACTION override. The fraction
+// only applies to finding motifs and discords on a computed profile. Profiles
+// are always computed with the library's zone, see profileExclusionZone.
+func initExclusionFraction() error {
+	if v := os.Getenv("EXCLUSION_FRACTION"); v != "" {
+		fraction, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return err
+		}
+		if !(fraction >= 0) || math.IsInf(fraction, 1) {
+			return fmt.Errorf("EXCLUSION_FRACTION must be a non-negative number, got %s", v)
+		}
+		exclusionFraction = fraction
+	}
+	return nil
+}
+
+// exclusionZone returns the number of neighboring subsequences on either side of
+// a subsequence that are treated as trivial matches when finding motifs and
+// discords for a window size of m
+func exclusionZone(m int) int {
+	return int(float64(m) * exclusionFraction)
+}
+
+// profileExclusionZone returns the number of neighboring subsequences on either
+// side of a subsequence that are excluded when computing a self join profile.
+// The library fixes it at m/2, so it does not follow exclusionFraction.
+func profileExclusionZone(m int) int {
+	return m / 2
+}
+
 func buildCORSHeaders(c *gin.Context) {
 	c.Header("Access-Control-Allow-Origin", "http://localhost:8080")
 	c.Header("Access-Control-Allow-Credentials", "true")
 	c.Header("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept")
-	c.Header("Access-Control-Allow-Methods", "GET, POST")
+	c.Header("Access-Control-Allow-Methods", "GET, POST, DELETE")
 }
 
+// fetchMPCache returns the matrix profile cached in the session or nil if there is
+// none or it cannot be decoded
 func fetchMPCache(session sessions.Session) interface{} {
 	start := time.Now()
 
@@ -128,18 +305,135 @@ func fetchMPCache(session sessions.Session) interface{} {
 	} else {
 		redisClientRequestDuration.WithLabelValues("GET", "200").Observe(time.Since(start).Seconds() * 1000)
 	}
+
+	if b, ok := v.([]byte); ok {
+		mp, err := decodeMP(b)
+		if err != nil {
+			return nil
+		}
+		// a profile that does not match its series is treated like an expired cache
+		if err := validateMP(mp); err != nil {
+			return nil
+		}
+		return mp
+	}
+	// sessions created before the compact encoding hold the matrix profile itself
 	return v
 }
 
-func storeMPCache(session sessions.Session, mp *matrixprofile.MatrixProfile) {
+// fetchStoredMPCache returns the matrix profile cached in the session as stored,
+// without the library's derived fields or the checks of fetchMPCache, for callers
+// that only work with the series and profile. The bool is false if there is no
+// profile or it cannot be decoded.
+func fetchStoredMPCache(session sessions.Session) (matrixprofile.MatrixProfile, bool) {
 	start := time.Now()
 
-	session.Set("mp", mp)
-	err := session.Save()
+	v := session.Get("mp")
+	if v == nil {
+		redisClientRequestDuration.WithLabelValues("GET", "500").Observe(time.Since(start).Seconds() * 1000)
+	} else {
+		redisClientRequestDuration.WithLabelValues("GET", "200").Observe(time.Since(start).Seconds() * 1000)
+	}
+
+	switch v := v.(type) {
+	case []byte:
+		mp, err := decodeStoredMP(v)
+		return mp, err == nil
+	case matrixprofile.MatrixProfile:
+		// sessions created before the compact encoding hold the matrix profile itself
+		return v, true
+	}
+	return matrixprofile.MatrixProfile{}, false
+}
+
+// mpCacheSize returns the number of bytes the encoded matrix profile occupies once
+// serialized into the session by the redis store
+func mpCacheSize(blob []byte) (int, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(map[interface{}]interface{}{"mp": blob}); err != nil {
+		return 0, err
+	}
+	return buf.Len(), nil
+}
+
+// storeMPCache saves the matrix profile to the session in its compact encoding.
+// errMPTooLarge is returned without attempting the save if the encoded profile
+// exceeds maxRedisBlobSize.
+func storeMPCache(session sessions.Session, mp *matrixprofile.MatrixProfile) error {
+	blob, err := encodeMP(mp)
+	if err != nil {
+		return err
+	}
+
+	size, err := mpCacheSize(blob)
+	if err != nil {
+		return err
+	}
+	if size > maxRedisBlobSize {
+		return errMPTooLarge
+	}
+
+	start := time.Now()
+
+	session.Set("mp", blob)
+	err = session.Save()
 
 	if err != nil {
 		redisClientRequestDuration.WithLabelValues("SET", "500").Observe(time.Since(start).Seconds() * 1000)
 	} else {
 		redisClientRequestDuration.WithLabelValues("SET", "200").Observe(time.Since(start).Seconds() * 1000)
 	}
+	return err
+}
+
+// replaceMPCache saves a newly computed matrix profile to the session along with
+// the parameters it was computed with, replacing the session's previous profile.
+// The motif snapshot tracked by /stream/append belongs to the previous profile
+// and is dropped.
+func replaceMPCache(session sessions.Session, mp *matrixprofile.MatrixProfile, params ComputeParams) error {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	session.Set("params", b)
+	session.Delete("motifs")
+	return storeMPCache(session, mp)
+}
+
+// fetchComputeParams returns the parameters the session's matrix profile was
+// computed with. Sessions saved before the parameters were recorded only ever
+// held profiles computed with STOMP.
+func fetchComputeParams(session sessions.Session) ComputeParams {
+	var params ComputeParams
+	b, ok := session.Get("params").([]byte)
+	if !ok || json.Unmarshal(b, &params) != nil {
+		return ComputeParams{Algorithm: stompAlgorithm}
+	}
+	return params
+}
+
+// clearMPCache removes the matrix profile from the session if there is one
+func clearMPCache(session sessions.Session) error {
+	start := time.Now()
+
+	session.Delete("mp")
+	session.Delete("params")
+	session.Delete("motifs")
+	err := session.Save()
+
+	if err != nil {
+		redisClientRequestDuration.WithLabelValues("DEL", "500").Observe(time.Since(start).Seconds() * 1000)
+	} else {
+		redisClientRequestDuration.WithLabelValues("DEL", "200").Observe(time.Since(start).Seconds() * 1000)
+	}
+	return err
+}
+
+// cacheErrorCode returns the HTTP status code to respond with for an error from
+// storeMPCache
+func cacheErrorCode(err error) int {
+	if err == errMPTooLarge {
+		return 507
+	}
+	return 500
 }
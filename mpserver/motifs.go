@@ -1,7 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
 	"strconv"
 	"time"
 
@@ -11,8 +17,306 @@ import (
 )
 
 type Motif struct {
-	Groups []matrixprofile.MotifGroup `json:"groups"`
-	Series [][][]float64              `json:"series"`
+	M         int           `json:"m"`
+	Algorithm string        `json:"algorithm"`
+	Groups    []MotifGroup  `json:"groups"`
+	Series    [][][]float64 `json:"series"`
+	SortBy    string        `json:"sort"`
+	Scores    []float64     `json:"scores"`
+
+	// Approximate is set when the profile was computed with STAMP under a time
+	// budget, in which case groups may be missing members
+	Approximate bool `json:"approximate"`
+
+	// Coverage is the fraction of the series covered by the members of all groups
+	Coverage float64 `json:"coverage"`
+
+	// TrivialExcluded is the number of group members that were dropped for falling
+	// within the exclusion zone of another member of the same group. A non zero
+	// value usually indicates a poor choice of window size or radius.
+	TrivialExcluded int `json:"trivial_excluded"`
+
+	// OverlapExcluded is the number of group members dropped for overlapping a
+	// member of an earlier group when distinct motifs are requested
+	OverlapExcluded int `json:"overlap_excluded"`
+
+	// Counts is the number of members in each group before the group was capped
+	// by the max_members query parameter. It is equal to the length of the group
+	// when no cap applied.
+	Counts []int `json:"counts"`
+
+	// Page is the slice of groups returned. Coverage and the trivial match count
+	// are always computed over every group.
+	Page
+}
+
+// MotifGroup is the response form of a matrixprofile.MotifGroup
+type MotifGroup struct {
+	Idx     []int   `json:"idx"`
+	MinDist float64 `json:"min_dist"`
+}
+
+// MarshalJSON also writes the group under the library's field names, which were
+// the only names before the snake_case ones were added. The old names are
+// deprecated and will be removed in the next release.
+func (g MotifGroup) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Idx     []int   `json:"idx"`
+		MinDist float64 `json:"min_dist"`
+
+		DeprecatedIdx     []int   `json:"Idx"`
+		DeprecatedMinDist float64 `json:"MinDist"`
+	}{g.Idx, g.MinDist, g.Idx, g.MinDist})
+}
+
+func toMotifGroups(groups []matrixprofile.MotifGroup) []MotifGroup {
+	out := make([]MotifGroup, len(groups))
+	for i, g := range groups {
+		out[i] = MotifGroup{Idx: g.Idx, MinDist: g.MinDist}
+	}
+	return out
+}
+
+// motifRecord is a single motif occurrence written by writeMotifsJSONL
+type motifRecord struct {
+	Group  int       `json:"group"`
+	Idx    int       `json:"idx"`
+	Dist   float64   `json:"dist"`
+	Values []float64 `json:"values"`
+}
+
+// writeMotifsJSONL writes one JSON record per line for every occurrence of every
+// group, numbering the groups from first. Dist is the group's minimum distance
+// and the values are z-normalized unless raw is set.
+func writeMotifsJSONL(w io.Writer, mp matrixprofile.MatrixProfile, groups []MotifGroup, first int, raw bool) error {
+	enc := json.NewEncoder(w)
+	for i, g := range groups {
+		for _, idx := range g.Idx {
+			values, err := subsequence(mp, idx)
+			if err != nil {
+				return err
+			}
+			if !raw {
+				values, err = matrixprofile.ZNormalize(values)
+				if err != nil {
+					return err
+				}
+			}
+
+			// Encode terminates every record with a newline
+			rec := motifRecord{Group: first + i, Idx: idx, Dist: g.MinDist, Values: values}
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// motifsAround builds a motif group seeded at idx. The group contains the seed
+// and every subsequence whose distance to it is within r times the distance of the
+// seed's nearest neighbor, taken in order of increasing distance while skipping
+// anything in the exclusion zone of a subsequence already in the group.
+func motifsAround(mp matrixprofile.MatrixProfile, idx int, r float64) (matrixprofile.MotifGroup, error) {
+	dp, err := distanceProfile(mp, idx)
+	if err != nil {
+		return matrixprofile.MotifGroup{}, err
+	}
+
+	exzone := exclusionZone(mp.M)
+	candidates := make([]int, 0, len(dp))
+	for j, d := range dp {
+		if !isFinite(d) || (j-idx <= exzone && idx-j <= exzone) {
+			continue
+		}
+		candidates = append(candidates, j)
+	}
+	if len(candidates) == 0 {
+		return matrixprofile.MotifGroup{}, errors.New("no subsequences outside the exclusion zone of the seed")
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return dp[candidates[i]] < dp[candidates[j]]
+	})
+
+	minDist := dp[candidates[0]]
+	members := []int{idx}
+	for _, j := range candidates {
+		if dp[j] > r*minDist {
+			break
+		}
+		members = append(members, j)
+	}
+	members, _ = removeTrivialMatches(members, exzone)
+
+	return matrixprofile.MotifGroup{Idx: members, MinDist: minDist}, nil
+}
+
+// removeTrivialMatches drops indices that fall within the exclusion zone of an
+// earlier index in the list, returning the remaining indices and how many were
+// dropped
+func removeTrivialMatches(idxs []int, exzone int) ([]int, int) {
+	kept := make([]int, 0, len(idxs))
+	for _, idx := range idxs {
+		trivial := false
+		for _, k := range kept {
+			if idx-k <= exzone && k-idx <= exzone {
+				trivial = true
+				break
+			}
+		}
+		if !trivial {
+			kept = append(kept, idx)
+		}
+	}
+	return kept, len(idxs) - len(kept)
+}
+
+// distinctMotifs greedily removes occurrences that overlap an occurrence of an
+// earlier group, visiting the groups in the order given. Groups left with fewer
+// than two members are dropped entirely, so fewer groups than requested may be
+// returned and later groups may lose members that the unconstrained discovery
+// would have kept. The number of dropped occurrences is also returned.
+func distinctMotifs(groups []matrixprofile.MotifGroup, m int) ([]matrixprofile.MotifGroup, int) {
+	var taken []int
+	var dropped int
+	distinct := make([]matrixprofile.MotifGroup, 0, len(groups))
+	for _, g := range groups {
+		members := make([]int, 0, len(g.Idx))
+		for _, idx := range g.Idx {
+			overlaps := false
+			for _, t := range taken {
+				if idx-t < m && t-idx < m {
+					overlaps = true
+					break
+				}
+			}
+			if !overlaps {
+				members = append(members, idx)
+			}
+		}
+
+		if len(members) < 2 {
+			dropped += len(g.Idx)
+			continue
+		}
+		dropped += len(g.Idx) - len(members)
+		taken = append(taken, members...)
+		distinct = append(distinct, matrixprofile.MotifGroup{Idx: members, MinDist: g.MinDist})
+	}
+	return distinct, dropped
+}
+
+// coveredSamples returns the number of distinct series samples spanned by
+// subsequences of length m starting at each of the indices. Only samples within a
+// series of length seriesLen are counted, so members that start before the series
+// or run past its end contribute just the part that overlaps it.
+func coveredSamples(idxs []int, m, seriesLen int) int {
+	sorted := append([]int(nil), idxs...)
+	sort.Ints(sorted)
+
+	var covered, end int
+	for _, idx := range sorted {
+		s, e := idx, idx+m
+		if s < end {
+			s = end
+		}
+		if e > seriesLen {
+			e = seriesLen
+		}
+		if e > s {
+			covered += e - s
+			end = e
+		}
+	}
+	return covered
+}
+
+// motifCoverage returns the fraction of a series of length seriesLen covered by
+// the subsequences of length m of all members of all motif groups. Samples covered
+// by overlapping members, within or across groups, are only counted once.
+func motifCoverage(groups []matrixprofile.MotifGroup, m, seriesLen int) float64 {
+	if seriesLen <= 0 {
+		return 0
+	}
+
+	var idxs []int
+	for _, g := range groups {
+		idxs = append(idxs, g.Idx...)
+	}
+	return float64(coveredSamples(idxs, m, seriesLen)) / float64(seriesLen)
+}
+
+// rankMotifs sorts the motif groups in place by the criterion and returns the
+// score of each group in the new order. Groups are ordered by ascending minimum
+// distance for "distance", by descending number of members for "frequency", by
+// descending number of covered samples for "coverage" and by ascending mean
+// annotation vector adjusted matrix profile value of the members for "av".
+func rankMotifs(mp matrixprofile.MatrixProfile, groups []matrixprofile.MotifGroup, criterion string) ([]float64, error) {
+	scores := make([]float64, len(groups))
+	ascending := true
+
+	switch criterion {
+	case "distance", "":
+		for i, g := range groups {
+			scores[i] = g.MinDist
+		}
+	case "frequency":
+		ascending = false
+		for i, g := range groups {
+			scores[i] = float64(len(g.Idx))
+		}
+	case "coverage":
+		ascending = false
+		for i, g := range groups {
+			scores[i] = float64(coveredSamples(g.Idx, mp.M, len(mp.A)))
+		}
+	case "av":
+		av, err := mp.GetAV()
+		if err != nil {
+			return nil, err
+		}
+		adjustedMP, err := mp.ApplyAV(av)
+		if err != nil {
+			return nil, err
+		}
+		for i, g := range groups {
+			var count int
+			for _, idx := range g.Idx {
+				if isFinite(adjustedMP[idx]) {
+					scores[i] += adjustedMP[idx]
+					count++
+				}
+			}
+			if count > 0 {
+				scores[i] /= float64(count)
+			} else {
+				scores[i] = math.Inf(1)
+			}
+		}
+	default:
+		return nil, errors.New("invalid motif sort criterion " + criterion)
+	}
+
+	order := make([]int, len(groups))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		if ascending {
+			return scores[order[i]] < scores[order[j]]
+		}
+		return scores[order[i]] > scores[order[j]]
+	})
+
+	sortedGroups := make([]matrixprofile.MotifGroup, len(groups))
+	sortedScores := make([]float64, len(groups))
+	for i, o := range order {
+		sortedGroups[i] = groups[o]
+		sortedScores[i] = scores[o]
+	}
+	copy(groups, sortedGroups)
+
+	return sortedScores, nil
 }
 
 func topKMotifs(c *gin.Context) {
@@ -38,6 +342,53 @@ func topKMotifs(c *gin.Context) {
 		return
 	}
 
+	// z-normalized subsequences are returned unless the raw values are requested
+	raw, err := strconv.ParseBool(c.DefaultQuery("raw", "false"))
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	// limits the number of members returned per group, 0 returns all of them
+	maxMembers, err := strconv.Atoi(c.DefaultQuery("max_members", "0"))
+	if err == nil && maxMembers < 0 {
+		err = errors.New("max_members must be non-negative")
+	}
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	// jsonl writes one occurrence per line instead of the nested response
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "jsonl" {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: fmt.Errorf("unsupported format %s", format)})
+		return
+	}
+
+	// distinct drops occurrences overlapping those of an earlier group
+	distinct, err := strconv.ParseBool(c.DefaultQuery("distinct", "false"))
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	offset, limit, err := parsePage(c)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
 	v := fetchMPCache(session)
 
 	var mp matrixprofile.MatrixProfile
@@ -61,13 +412,95 @@ func topKMotifs(c *gin.Context) {
 		return
 	}
 
+	var trivialExcluded int
+	for i, g := range motifGroups {
+		var excluded int
+		motifGroups[i].Idx, excluded = removeTrivialMatches(g.Idx, exclusionZone(mp.M))
+		trivialExcluded += excluded
+	}
+
+	var overlapExcluded int
+	if distinct {
+		motifGroups, overlapExcluded = distinctMotifs(motifGroups, mp.M)
+	}
+
+	sortBy := c.DefaultQuery("sort", "distance")
+	scores, err := rankMotifs(mp, motifGroups, sortBy)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
 	var motif Motif
-	motif.Groups = motifGroups
-	motif.Series = make([][][]float64, len(motifGroups))
+	motif.M = mp.M
+	computeParams := fetchComputeParams(session)
+	motif.Algorithm = computeParams.Algorithm
+	motif.Approximate = computeParams.Algorithm == stampAlgorithm
+	motif.Groups = toMotifGroups(motifGroups)
+	motif.SortBy = sortBy
+	motif.Scores = scores
+	motif.TrivialExcluded = trivialExcluded
+	motif.OverlapExcluded = overlapExcluded
+	motif.Coverage = motifCoverage(motifGroups, mp.M, len(mp.A))
+
+	// coverage and scores are computed over every member, only the response is
+	// truncated so that the indices and series stay aligned for the client
+	motif.Counts = make([]int, len(motifGroups))
+	for i, g := range motif.Groups {
+		motif.Counts[i] = len(g.Idx)
+		if maxMembers > 0 && len(g.Idx) > maxMembers {
+			motif.Groups[i].Idx = g.Idx[:maxMembers]
+		}
+	}
+
+	// groups are paged after ranking so that pages follow the requested order
+	lo, hi, page, err := paginate(len(motif.Groups), offset, limit)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+	motif.Page = page
+	motif.Groups = motif.Groups[lo:hi]
+	motif.Scores = motif.Scores[lo:hi]
+	motif.Counts = motif.Counts[lo:hi]
+
+	if format == "jsonl" {
+		var buf bytes.Buffer
+		if err := writeMotifsJSONL(&buf, mp, motif.Groups, lo, raw); err != nil {
+			requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+			serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+			c.JSON(500, RespError{Error: err})
+			return
+		}
+
+		requestTotal.WithLabelValues(method, endpoint, "200").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.Data(200, "application/x-ndjson", buf.Bytes())
+		return
+	}
+
+	motif.Series = make([][][]float64, len(motif.Groups))
 	for i, g := range motif.Groups {
 		motif.Series[i] = make([][]float64, len(g.Idx))
 		for j, midx := range g.Idx {
-			motif.Series[i][j], err = matrixprofile.ZNormalize(mp.A[midx : midx+mp.M])
+			subseq, err := subsequence(mp, midx)
+			if err != nil {
+				requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+				serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+				c.JSON(500, RespError{Error: err})
+				return
+			}
+
+			if raw {
+				motif.Series[i][j] = subseq
+				continue
+			}
+
+			motif.Series[i][j], err = matrixprofile.ZNormalize(subseq)
 			if err != nil {
 				requestTotal.WithLabelValues(method, endpoint, "500").Inc()
 				serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
@@ -81,3 +514,81 @@ func topKMotifs(c *gin.Context) {
 	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
 	c.JSON(200, motif)
 }
+
+func getMotifsAround(c *gin.Context) {
+	start := time.Now()
+	endpoint := "/api/v1/motifsaround"
+	method := "GET"
+	session := sessions.Default(c)
+	buildCORSHeaders(c)
+
+	idx, err := strconv.Atoi(c.Query("idx"))
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	r, err := strconv.ParseFloat(c.Query("r"), 64)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	v := fetchMPCache(session)
+	var mp matrixprofile.MatrixProfile
+	if v == nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{
+			Error:        errors.New("matrix profile is not initialized to compute motifs"),
+			CacheExpired: true,
+		})
+		return
+	} else {
+		mp = v.(matrixprofile.MatrixProfile)
+	}
+
+	group, err := motifsAround(mp, idx, r)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	computeParams := fetchComputeParams(session)
+	motif := Motif{
+		M:           mp.M,
+		Algorithm:   computeParams.Algorithm,
+		Approximate: computeParams.Algorithm == stampAlgorithm,
+		Groups:      toMotifGroups([]matrixprofile.MotifGroup{group}),
+		Series:      [][][]float64{make([][]float64, len(group.Idx))},
+		SortBy:      "distance",
+		Scores:      []float64{group.MinDist},
+	}
+	for j, midx := range group.Idx {
+		subseq, err := subsequence(mp, midx)
+		if err != nil {
+			requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+			serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+			c.JSON(500, RespError{Error: err})
+			return
+		}
+
+		motif.Series[0][j], err = matrixprofile.ZNormalize(subseq)
+		if err != nil {
+			requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+			serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+			c.JSON(500, RespError{Error: err})
+			return
+		}
+	}
+
+	requestTotal.WithLabelValues(method, endpoint, "200").Inc()
+	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+	c.JSON(200, motif)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/aouyang1/go-matrixprofile/matrixprofile"
+)
+
+func TestCoveredSamples(t *testing.T) {
+	testData := []struct {
+		idxs      []int
+		m         int
+		seriesLen int
+		expected  int
+	}{
+		{[]int{}, 4, 20, 0},
+		{[]int{0}, 4, 20, 4},
+		// disjoint
+		{[]int{0, 10}, 4, 20, 8},
+		// adjacent members share no samples
+		{[]int{0, 4, 8}, 4, 20, 12},
+		// overlapping members, in any order, count shared samples once
+		{[]int{0, 2}, 4, 20, 6},
+		{[]int{6, 0, 3}, 4, 20, 10},
+		{[]int{5, 5}, 4, 20, 4},
+		// one member contained within the span of two others
+		{[]int{0, 3, 1}, 4, 20, 7},
+		// out of range members only count the part within the series
+		{[]int{18}, 4, 20, 2},
+		{[]int{-2}, 4, 20, 2},
+		{[]int{-2, 0}, 4, 20, 4},
+		{[]int{16, 18}, 4, 20, 4},
+		{[]int{20, 25}, 4, 20, 0},
+		{[]int{-10}, 4, 20, 0},
+	}
+
+	for _, d := range testData {
+		covered := coveredSamples(d.idxs, d.m, d.seriesLen)
+		if covered != d.expected {
+			t.Errorf("expected %d samples covered by %v with m=%d but got %d", d.expected, d.idxs, d.m, covered)
+		}
+	}
+}
+
+func TestMotifCoverage(t *testing.T) {
+	testData := []struct {
+		groups    []matrixprofile.MotifGroup
+		m         int
+		seriesLen int
+		expected  float64
+	}{
+		{nil, 4, 20, 0},
+		{[]matrixprofile.MotifGroup{{Idx: []int{0, 10}}}, 4, 20, 0.4},
+		// overlap across groups is only counted once
+		{[]matrixprofile.MotifGroup{{Idx: []int{0, 10}}, {Idx: []int{2, 16}}}, 4, 20, 0.7},
+		{[]matrixprofile.MotifGroup{{Idx: []int{0, 4}}, {Idx: []int{8, 12, 16}}}, 4, 20, 1},
+		// coverage never exceeds the series
+		{[]matrixprofile.MotifGroup{{Idx: []int{-2, 18}}, {Idx: []int{0, 4, 8, 12, 16}}}, 4, 20, 1},
+		{[]matrixprofile.MotifGroup{{Idx: []int{0}}}, 4, 0, 0},
+	}
+
+	for _, d := range testData {
+		coverage := motifCoverage(d.groups, d.m, d.seriesLen)
+		if math.Abs(coverage-d.expected) > 1e-9 {
+			t.Errorf("expected coverage %f for %v but got %f", d.expected, d.groups, coverage)
+		}
+	}
+}
+
+func TestMotifGroupJSON(t *testing.T) {
+	b, err := json.Marshal(MotifGroup{Idx: []int{3, 40}, MinDist: 1.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatal(err)
+	}
+	// the deprecated names are written alongside the snake_case ones
+	for _, k := range []string{"idx", "min_dist", "Idx", "MinDist"} {
+		if _, ok := fields[k]; !ok {
+			t.Errorf("expected field %s in %s", k, b)
+		}
+	}
+
+	var g MotifGroup
+	if err := json.Unmarshal(b, &g); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Idx) != 2 || g.Idx[0] != 3 || g.Idx[1] != 40 || g.MinDist != 1.5 {
+		t.Errorf("expected the group to decode back to itself but got %+v", g)
+	}
+}
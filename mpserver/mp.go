@@ -2,6 +2,9 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"math"
+	"strconv"
 	"time"
 
 	"github.com/aouyang1/go-matrixprofile/matrixprofile"
@@ -10,8 +13,14 @@ import (
 )
 
 type MP struct {
+	M          int       `json:"m"`
+	Algorithm  string    `json:"algorithm"`
 	AV         []float64 `json:"annotation_vector"`
 	AdjustedMP []float64 `json:"adjusted_mp"`
+
+	// Approximate is set when the profile was computed with STAMP under a time
+	// budget
+	Approximate bool `json:"approximate"`
 }
 
 func getMP(c *gin.Context) {
@@ -49,16 +58,8 @@ func getMP(c *gin.Context) {
 		mp = v.(matrixprofile.MatrixProfile)
 	}
 
-	switch avname {
-	case "default", "":
-		mp.AV = matrixprofile.DefaultAV
-	case "complexity":
-		mp.AV = matrixprofile.ComplexityAV
-	case "meanstd":
-		mp.AV = matrixprofile.MeanStdAV
-	case "clipping":
-		mp.AV = matrixprofile.ClippingAV
-	default:
+	avType, ok := annotationVector(avname)
+	if !ok {
 		requestTotal.WithLabelValues("POST", endpoint, "500").Inc()
 		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
 		c.JSON(500, RespError{
@@ -66,9 +67,16 @@ func getMP(c *gin.Context) {
 		})
 		return
 	}
+	mp.AV = avType
 
 	// cache matrix profile for current session
-	storeMPCache(session, &mp)
+	if err := storeMPCache(session, &mp); err != nil {
+		code := cacheErrorCode(err)
+		requestTotal.WithLabelValues("POST", endpoint, strconv.Itoa(code)).Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(code, RespError{Error: err})
+		return
+	}
 
 	av, err := mp.GetAV()
 	if err != nil {
@@ -88,5 +96,92 @@ func getMP(c *gin.Context) {
 
 	requestTotal.WithLabelValues("POST", endpoint, "200").Inc()
 	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
-	c.JSON(200, MP{AV: av, AdjustedMP: adjustedMP})
+	computeParams := fetchComputeParams(session)
+	c.JSON(200, MP{
+		M:           mp.M,
+		Algorithm:   computeParams.Algorithm,
+		Approximate: computeParams.Algorithm == stampAlgorithm,
+		AV:          av,
+		AdjustedMP:  adjustedMP,
+	})
+}
+
+// deleteMP clears the cached matrix profile for the session. It succeeds even if
+// nothing was cached.
+func deleteMP(c *gin.Context) {
+	start := time.Now()
+	endpoint := "/api/v1/mp"
+	method := "DELETE"
+	session := sessions.Default(c)
+	buildCORSHeaders(c)
+
+	if err := clearMPCache(session); err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+	cacheClearTotal.Inc()
+
+	requestTotal.WithLabelValues(method, endpoint, "204").Inc()
+	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+	c.Status(204)
+}
+
+// subsequence returns the i-th subsequence of length m from the matrix profile's
+// series. The returned slice is a view into mp.A and must not be modified by the
+// caller. An error is returned if i is outside of [0, len(mp.A)-mp.M].
+func subsequence(mp matrixprofile.MatrixProfile, i int) ([]float64, error) {
+	if i < 0 || i > len(mp.A)-mp.M {
+		return nil, fmt.Errorf("subsequence index %d is out of range [0, %d]", i, len(mp.A)-mp.M)
+	}
+	return mp.A[i : i+mp.M], nil
+}
+
+// isFinite reports whether a matrix profile value holds a real distance. NaN and
+// infinite values mark positions that were not computed or are degenerate.
+func isFinite(d float64) bool {
+	return !math.IsNaN(d) && !math.IsInf(d, 0)
+}
+
+// minIgnoreNaN returns the smallest finite value and its index, ignoring NaN and
+// infinite values. The index is -1 if there are no finite values.
+func minIgnoreNaN(vals []float64) (float64, int) {
+	minIdx := -1
+	for i, v := range vals {
+		if isFinite(v) && (minIdx < 0 || v < vals[minIdx]) {
+			minIdx = i
+		}
+	}
+	if minIdx < 0 {
+		return math.NaN(), -1
+	}
+	return vals[minIdx], minIdx
+}
+
+// maxIgnoreNaN returns the largest finite value and its index, ignoring NaN and
+// infinite values. The index is -1 if there are no finite values.
+func maxIgnoreNaN(vals []float64) (float64, int) {
+	maxIdx := -1
+	for i, v := range vals {
+		if isFinite(v) && (maxIdx < 0 || v > vals[maxIdx]) {
+			maxIdx = i
+		}
+	}
+	if maxIdx < 0 {
+		return math.NaN(), -1
+	}
+	return vals[maxIdx], maxIdx
+}
+
+// normalizedMP scales the matrix profile distances to [0, 1] by dividing by
+// 2*sqrt(m), the largest possible z-normalized euclidean distance between two
+// subsequences of length m. This makes distances comparable across window sizes.
+func normalizedMP(mp matrixprofile.MatrixProfile) []float64 {
+	maxDist := 2 * math.Sqrt(float64(mp.M))
+	nmp := make([]float64, len(mp.MP))
+	for i, d := range mp.MP {
+		nmp[i] = d / maxDist
+	}
+	return nmp
 }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Page describes which slice of a result list was returned. NextOffset is nil
+// once the last page has been reached.
+type Page struct {
+	Offset     int  `json:"offset"`
+	Limit      int  `json:"limit"`
+	Total      int  `json:"total"`
+	NextOffset *int `json:"next_offset"`
+}
+
+// parsePage reads the offset and limit query parameters. A limit of 0, the
+// default, returns everything from the offset onwards.
+func parsePage(c *gin.Context) (int, int, error) {
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil {
+		return 0, 0, err
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "0"))
+	if err != nil {
+		return 0, 0, err
+	}
+	if offset < 0 || limit < 0 {
+		return 0, 0, errors.New("offset and limit must be non-negative")
+	}
+	return offset, limit, nil
+}
+
+// paginate returns the bounds of the requested page within a list of total items
+func paginate(total, offset, limit int) (int, int, Page, error) {
+	if offset > total {
+		return 0, 0, Page{}, fmt.Errorf("offset %d is past the %d results available", offset, total)
+	}
+
+	end := total
+	if limit > 0 && offset+limit < total {
+		end = offset + limit
+	}
+
+	page := Page{Offset: offset, Limit: limit, Total: total}
+	if end < total {
+		page.NextOffset = &end
+	}
+	return offset, end, page, nil
+}
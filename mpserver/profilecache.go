@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aouyang1/go-matrixprofile/matrixprofile"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	warmupSource          = "demo"    // override with WARMUP_SOURCE environment variable
+	maxCachedProfiles     = 32        // override with MAX_CACHED_PROFILES environment variable
+	maxCachedProfileBytes = 256 << 20 // override with MAX_CACHED_PROFILE_BYTES environment variable
+)
+
+// cachedProfile holds a matrix profile without its index, which is kept in idx
+// in its compact form to reduce the memory held by the cache. size is the memory
+// held by both, as counted against the byte budget.
+type cachedProfile struct {
+	mp      *matrixprofile.MatrixProfile
+	idx     profileIndex
+	params  ComputeParams
+	expires time.Time
+	size    int
+}
+
+// profileCall is a computation of a profile that concurrent misses on the same
+// key wait on instead of computing it again
+type profileCall struct {
+	wg     sync.WaitGroup
+	mp     *matrixprofile.MatrixProfile
+	params ComputeParams
+	err    error
+}
+
+// profileCache is a server wide cache of computed matrix profiles shared across
+// sessions. Entries expire after ttl and the entries closest to expiring are
+// evicted once maxEntries or maxBytes is reached. Profiles are copied on the way
+// in and out so callers are free to modify what they pass and get back.
+type profileCache struct {
+	sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	maxBytes   int
+	bytes      int
+	entries    map[string]cachedProfile
+	calls      map[string]*profileCall
+}
+
+func newProfileCache(ttl time.Duration, maxEntries, maxBytes int) *profileCache {
+	return &profileCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		entries:    make(map[string]cachedProfile),
+		calls:      make(map[string]*profileCall),
+	}
+}
+
+var profiles = newProfileCache(time.Duration(retentionPeriod)*time.Second, maxCachedProfiles, maxCachedProfileBytes)
+
+// initProfileCache applies the environment overrides for the shared profile cache
+func initProfileCache() error {
+	if s := os.Getenv("WARMUP_SOURCE"); s != "" {
+		warmupSource = s
+	}
+	if v := os.Getenv("MAX_CACHED_PROFILES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		maxCachedProfiles = n
+	}
+	if v := os.Getenv("MAX_CACHED_PROFILE_BYTES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		maxCachedProfileBytes = n
+	}
+	profiles = newProfileCache(time.Duration(retentionPeriod)*time.Second, maxCachedProfiles, maxCachedProfileBytes)
+	return nil
+}
+
+// profileKey identifies a computed matrix profile by a hash of the exact series it
+// is computed on and the window size. Since the hash is taken after preprocessing,
+// identical data from different sources shares an entry while live sources whose
+// data has changed do not hit a stale one.
+func profileKey(data []float64, m int) string {
+	return fmt.Sprintf("%s|%d", hashSeries(data), m)
+}
+
+// copyMP returns a copy of the matrix profile that shares no slices with it. The
+// second series of a self join stays the same slice as the first.
+func copyMP(mp *matrixprofile.MatrixProfile) *matrixprofile.MatrixProfile {
+	c := *mp
+	c.A = append([]float64(nil), mp.A...)
+	c.B = append([]float64(nil), mp.B...)
+	if len(mp.A) > 0 && len(mp.B) > 0 && &mp.A[0] == &mp.B[0] {
+		c.B = c.A
+	}
+	c.AMean = append([]float64(nil), mp.AMean...)
+	c.AStd = append([]float64(nil), mp.AStd...)
+	c.BF = append([]complex128(nil), mp.BF...)
+	c.MP = append([]float64(nil), mp.MP...)
+	c.Idx = append([]int(nil), mp.Idx...)
+	return &c
+}
+
+// profileBytes returns the memory held by the slices of a cached profile
+func profileBytes(mp *matrixprofile.MatrixProfile, idx profileIndex) int {
+	size := 8*(len(mp.A)+len(mp.AMean)+len(mp.AStd)+len(mp.MP)) + 16*len(mp.BF) + idx.sizeBytes()
+	if len(mp.B) > 0 && (len(mp.A) == 0 || &mp.A[0] != &mp.B[0]) {
+		size += 8 * len(mp.B)
+	}
+	return size
+}
+
+func (pc *profileCache) get(key string) (*matrixprofile.MatrixProfile, ComputeParams, bool) {
+	pc.Lock()
+	defer pc.Unlock()
+
+	e, ok := pc.entries[key]
+	if ok && time.Now().After(e.expires) {
+		pc.remove(key)
+		ok = false
+	}
+	if !ok {
+		profileCacheRequestTotal.WithLabelValues("miss").Inc()
+		return nil, ComputeParams{}, false
+	}
+
+	profileCacheRequestTotal.WithLabelValues("hit").Inc()
+	// the library works with an []int index so each hit gets its own expanded
+	// copy, which is garbage once the request is done
+	mp := copyMP(e.mp)
+	mp.Idx = e.idx.Ints()
+	return mp, e.params, true
+}
+
+func (pc *profileCache) set(key string, mp *matrixprofile.MatrixProfile, params ComputeParams) {
+	if pc.maxEntries <= 0 || pc.maxBytes <= 0 {
+		return
+	}
+
+	compact := copyMP(mp)
+	compact.Idx = nil
+	idx := newProfileIndex(mp.Idx)
+	size := profileBytes(compact, idx)
+	if size > pc.maxBytes {
+		// it would evict everything else and still not fit
+		return
+	}
+
+	pc.Lock()
+	defer pc.Unlock()
+
+	pc.remove(key)
+	now := time.Now()
+	for k, e := range pc.entries {
+		if now.After(e.expires) {
+			pc.remove(k)
+		}
+	}
+	for len(pc.entries) >= pc.maxEntries || pc.bytes+size > pc.maxBytes {
+		var oldest string
+		for k, e := range pc.entries {
+			if oldest == "" || e.expires.Before(pc.entries[oldest].expires) {
+				oldest = k
+			}
+		}
+		pc.remove(oldest)
+	}
+
+	pc.entries[key] = cachedProfile{
+		mp:      compact,
+		idx:     idx,
+		params:  params,
+		expires: now.Add(pc.ttl),
+		size:    size,
+	}
+	pc.bytes += size
+}
+
+// remove deletes the entry for key if present. The lock must be held.
+func (pc *profileCache) remove(key string) {
+	if e, ok := pc.entries[key]; ok {
+		pc.bytes -= e.size
+		delete(pc.entries, key)
+	}
+}
+
+// compute returns the profile for key from the shared cache, calling fn to
+// compute and cache it if it is not present. Concurrent misses on the same key
+// wait for a single call to fn and each get their own copy of its result. The
+// returned bool reports whether fn was not called for this request.
+func (pc *profileCache) compute(key string, fn func() (*matrixprofile.MatrixProfile, ComputeParams, error)) (*matrixprofile.MatrixProfile, ComputeParams, bool, error) {
+	if mp, params, ok := pc.get(key); ok {
+		return mp, params, true, nil
+	}
+
+	pc.Lock()
+	if call, ok := pc.calls[key]; ok {
+		pc.Unlock()
+		call.wg.Wait()
+		if call.err != nil {
+			return nil, call.params, false, call.err
+		}
+		return copyMP(call.mp), call.params, true, nil
+	}
+	call := &profileCall{}
+	call.wg.Add(1)
+	pc.calls[key] = call
+	pc.Unlock()
+
+	mp, params, err := fn()
+	if err == nil {
+		pc.set(key, mp, params)
+		call.mp = copyMP(mp)
+	}
+	call.params, call.err = params, err
+
+	pc.Lock()
+	delete(pc.calls, key)
+	pc.Unlock()
+	call.wg.Done()
+
+	return mp, params, false, err
+}
+
+// computeCachedMP returns the matrix profile for key from the shared cache,
+// computing and caching it if it is not present. trigger labels what caused the
+// computation in the compute metrics. The returned bool reports whether the profile
+// came from the cache, including when it was computed by a concurrent request.
+func computeCachedMP(key string, data []float64, m int, trigger string) (*matrixprofile.MatrixProfile, ComputeParams, bool, error) {
+	return profiles.compute(key, func() (*matrixprofile.MatrixProfile, ComputeParams, error) {
+		mp, params, err := computeMP(data, m)
+		if err != nil {
+			return nil, params, err
+		}
+		computeTotal.WithLabelValues(trigger).Inc()
+		return mp, params, nil
+	})
+}
+
+type Warmup struct {
+	Source string `json:"source"`
+	M      int    `json:"m"`
+	Cached bool   `json:"cached"`
+}
+
+// warmup computes and caches the matrix profile for a source ahead of user
+// requests. It returns immediately if the profile is already cached.
+func warmup(c *gin.Context) {
+	start := time.Now()
+	endpoint := "/api/v1/warmup"
+	method := "POST"
+	buildCORSHeaders(c)
+
+	m, err := strconv.Atoi(c.Query("m"))
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+	if m <= 0 {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: errors.New("window size m must be positive")})
+		return
+	}
+	source := c.DefaultQuery("source", warmupSource)
+
+	data, err := fetchData(source)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	_, _, cached, err := computeCachedMP(profileKey(data.Data, m), data.Data, m, "warmup")
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	requestTotal.WithLabelValues(method, endpoint, "200").Inc()
+	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+	c.JSON(200, Warmup{Source: source, M: m, Cached: cached})
+}
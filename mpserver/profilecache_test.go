@@ -0,0 +1,113 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aouyang1/go-matrixprofile/matrixprofile"
+)
+
+func TestProfileCacheCopies(t *testing.T) {
+	pc := newProfileCache(time.Minute, 4, 1<<20)
+	mp := randomWalkMP(t, 100, 8)
+	a0, mp0, idx0 := mp.A[0], mp.MP[0], mp.Idx[0]
+
+	pc.set("k", mp, ComputeParams{M: 8})
+	mp.A[0], mp.MP[0], mp.Idx[0] = -1, -1, -1
+
+	got, _, ok := pc.get("k")
+	if !ok {
+		t.Fatal("expected a hit")
+	}
+	if got.A[0] != a0 || got.MP[0] != mp0 || got.Idx[0] != idx0 {
+		t.Error("expected changes to the profile passed to set not to reach the cache")
+	}
+	if &got.A[0] != &got.B[0] {
+		t.Error("expected the copy of a self join to keep a single series")
+	}
+
+	got.A[0], got.MP[0] = -2, -2
+	again, _, _ := pc.get("k")
+	if again.A[0] != a0 || again.MP[0] != mp0 {
+		t.Error("expected changes to a profile returned by get not to reach the cache")
+	}
+}
+
+func TestProfileCacheByteBudget(t *testing.T) {
+	mp := randomWalkMP(t, 100, 8)
+	size := profileBytes(mp, newProfileIndex(mp.Idx))
+
+	// room for two profiles by bytes even though four are allowed by count
+	pc := newProfileCache(time.Minute, 4, 2*size+size/2)
+	for _, k := range []string{"a", "b", "c"} {
+		pc.set(k, mp, ComputeParams{})
+		time.Sleep(time.Millisecond)
+	}
+	if len(pc.entries) != 2 {
+		t.Fatalf("expected 2 entries within the byte budget but got %d", len(pc.entries))
+	}
+	if _, ok := pc.entries["a"]; ok {
+		t.Error("expected the entry closest to expiring to be evicted")
+	}
+	if pc.bytes > pc.maxBytes {
+		t.Errorf("expected at most %d bytes cached but got %d", pc.maxBytes, pc.bytes)
+	}
+
+	// replacing an entry does not count it twice
+	pc.set("c", mp, ComputeParams{})
+	if len(pc.entries) != 2 || pc.bytes != 2*size {
+		t.Errorf("expected 2 entries of %d bytes but got %d entries of %d bytes", size, len(pc.entries), pc.bytes)
+	}
+
+	// a profile larger than the whole budget is not cached
+	small := newProfileCache(time.Minute, 4, size-1)
+	small.set("a", mp, ComputeParams{})
+	if len(small.entries) != 0 || small.bytes != 0 {
+		t.Error("expected a profile over the byte budget not to be cached")
+	}
+}
+
+func TestProfileCacheCoalescesMisses(t *testing.T) {
+	pc := newProfileCache(time.Minute, 4, 1<<20)
+	mp := randomWalkMP(t, 100, 8)
+
+	var calls int32
+	release := make(chan struct{})
+	fn := func() (*matrixprofile.MatrixProfile, ComputeParams, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return copyMP(mp), ComputeParams{M: 8}, nil
+	}
+
+	const requests = 8
+	results := make([]*matrixprofile.MatrixProfile, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			got, params, _, err := pc.compute("k", fn)
+			if err != nil || params.M != 8 {
+				t.Errorf("unexpected result %+v, %v", params, err)
+				return
+			}
+			results[i] = got
+		}(i)
+	}
+	// give every request the chance to miss before the computation finishes
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("expected a single computation for concurrent misses but got %d", n)
+	}
+	for i := 1; i < requests; i++ {
+		if results[i] != nil && results[0] != nil && &results[i].MP[0] == &results[0].MP[0] {
+			t.Error("expected every request to get its own copy")
+			break
+		}
+	}
+}
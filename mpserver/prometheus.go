@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+var (
+	prometheusURL   = ""             // override with PROMETHEUS_URL environment variable. Empty disables the prometheus source
+	prometheusRange = 24 * time.Hour // override with PROMETHEUS_RANGE environment variable
+	prometheusStep  = time.Minute    // override with PROMETHEUS_STEP environment variable
+)
+
+// prometheusSource fetches series from the Prometheus range query API. The name
+// passed to fetch is the PromQL query, which must evaluate to a single series over
+// the configured range ending now.
+type prometheusSource struct {
+	url      string
+	lookback time.Duration
+	step     time.Duration
+	client   *http.Client
+}
+
+type prometheusResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Values [][2]interface{} `json:"values"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// initPrometheusSource registers the prometheus data source if PROMETHEUS_URL is set
+func initPrometheusSource() error {
+	if u := os.Getenv("PROMETHEUS_URL"); u != "" {
+		prometheusURL = u
+	}
+	if prometheusURL == "" {
+		return nil
+	}
+
+	if v := os.Getenv("PROMETHEUS_RANGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		prometheusRange = d
+	}
+	if v := os.Getenv("PROMETHEUS_STEP"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		prometheusStep = d
+	}
+
+	dataSources[prometheusPrefix] = &prometheusSource{
+		url:      prometheusURL,
+		lookback: prometheusRange,
+		step:     prometheusStep,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+	return nil
+}
+
+func (p *prometheusSource) fetch(query string) (Data, error) {
+	end := time.Now()
+	params := url.Values{}
+	params.Set("query", query)
+	params.Set("start", strconv.FormatInt(end.Add(-p.lookback).Unix(), 10))
+	params.Set("end", strconv.FormatInt(end.Unix(), 10))
+	params.Set("step", strconv.FormatFloat(p.step.Seconds(), 'f', -1, 64))
+
+	resp, err := p.client.Get(p.url + "/api/v1/query_range?" + params.Encode())
+	if err != nil {
+		return Data{}, err
+	}
+	defer resp.Body.Close()
+
+	var pr prometheusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&pr); err != nil {
+		return Data{}, err
+	}
+	if pr.Status != "success" {
+		return Data{}, fmt.Errorf("prometheus query failed: %s", pr.Error)
+	}
+	if pr.Data.ResultType != "matrix" || len(pr.Data.Result) != 1 {
+		return Data{}, errors.New("prometheus query must return exactly one series")
+	}
+
+	values := pr.Data.Result[0].Values
+	ts := make([]float64, len(values))
+	vals := make([]float64, len(values))
+	for i, v := range values {
+		t, ok := v[0].(float64)
+		if !ok {
+			return Data{}, errors.New("unexpected prometheus sample timestamp format")
+		}
+		s, ok := v[1].(string)
+		if !ok {
+			return Data{}, errors.New("unexpected prometheus sample value format")
+		}
+		ts[i] = t
+		vals[i], err = strconv.ParseFloat(s, 64)
+		if err != nil {
+			return Data{}, err
+		}
+	}
+
+	// samples missing from the range leave gaps, so put the series back onto a
+	// uniform grid at the query step
+	grid, rvals, err := resample(ts, vals, p.step.Seconds(), "linear")
+	if err != nil {
+		return Data{}, err
+	}
+
+	return Data{Data: rvals, Timestamps: grid}, nil
+}
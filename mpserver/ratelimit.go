@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxRateLimitBuckets is the number of tracked clients after which idle buckets
+// are swept to keep memory bounded
+const maxRateLimitBuckets = 10000
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a per client token bucket limiter. Each client is allowed to
+// burst up to burst requests and is refilled at rate requests per second.
+type rateLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow reports whether the client identified by key may make a request now and
+// consumes a token if so
+func (rl *rateLimiter) allow(key string) bool {
+	rl.Lock()
+	defer rl.Unlock()
+
+	now := time.Now()
+	if len(rl.buckets) >= maxRateLimitBuckets {
+		rl.sweep(now)
+	}
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * rl.rate
+	if b.tokens > rl.burst {
+		b.tokens = rl.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep removes buckets that have been idle long enough to be completely refilled
+// since they are indistinguishable from a new client
+func (rl *rateLimiter) sweep(now time.Time) {
+	idle := time.Duration(rl.burst / rl.rate * float64(time.Second))
+	for k, b := range rl.buckets {
+		if now.Sub(b.last) > idle {
+			delete(rl.buckets, k)
+		}
+	}
+}
+
+// clientKey identifies the client of a request by the address of its connection.
+// X-Forwarded-For and X-Real-IP are ignored since any client can set them to get
+// a fresh bucket on every request.
+func clientKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimit returns a middleware that rejects requests with a 429 once a client
+// exceeds its request budget. A nil limiter disables rate limiting.
+func rateLimit(rl *rateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if rl == nil || rl.allow(clientKey(c.Request)) {
+			c.Next()
+			return
+		}
+
+		requestTotal.WithLabelValues(c.Request.Method, c.Request.URL.Path, "429").Inc()
+		c.AbortWithStatusJSON(429, RespError{
+			Error: errors.New("rate limit exceeded, try again later"),
+		})
+	}
+}
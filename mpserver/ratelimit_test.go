@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientKey(t *testing.T) {
+	testData := []struct {
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		{"10.0.0.1:1234", nil, "10.0.0.1"},
+		{"[::1]:1234", nil, "::1"},
+		{"10.0.0.1", nil, "10.0.0.1"},
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "10.0.0.1"},
+		{"10.0.0.1:1234", map[string]string{"X-Real-IP": "1.2.3.4"}, "10.0.0.1"},
+	}
+
+	for _, d := range testData {
+		r := httptest.NewRequest("GET", "/api/v1/topkmotifs", nil)
+		r.RemoteAddr = d.remoteAddr
+		for k, v := range d.headers {
+			r.Header.Set(k, v)
+		}
+		if key := clientKey(r); key != d.expected {
+			t.Errorf("expected key %s for %s with headers %v but got %s", d.expected, d.remoteAddr, d.headers, key)
+		}
+	}
+}
+
+func TestRateLimiterIgnoresSpoofedHeaders(t *testing.T) {
+	rl := newRateLimiter(0.001, 2)
+
+	allowed := 0
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "4.4.4.4"} {
+		r := httptest.NewRequest("GET", "/api/v1/topkmotifs", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("X-Forwarded-For", ip)
+		if rl.allow(clientKey(r)) {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("expected only the burst of 2 requests to be allowed but %d were", allowed)
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/topkmotifs", nil)
+	r.RemoteAddr = "10.0.0.2:1234"
+	if !rl.allow(clientKey(r)) {
+		t.Error("expected a request from another address to be allowed")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aouyang1/go-matrixprofile/matrixprofile"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// defaultFlussFactor is the number of window lengths at either end of the
+// corrected arc curve that are suppressed by default
+const defaultFlussFactor = 5
+
+type Segments struct {
+	M         int       `json:"m"`
+	Algorithm string    `json:"algorithm"`
+	Factor    int       `json:"factor"`
+	CAC       []float64 `json:"cac"`
+}
+
+// arcCounts returns for each position of the matrix profile the number of arcs
+// from a subsequence to its nearest neighbor that cross over that position. An
+// arc crosses the positions strictly between its two ends, as in FLUSS, so these
+// are the counts the library's Segment derives its corrected arc curve from.
+// Index entries that are out of range, such as uncomputed neighbors, do not
+// contribute arcs.
+func arcCounts(mp matrixprofile.MatrixProfile) []int {
+	marks := make([]int, len(mp.Idx)+1)
+	for i, j := range mp.Idx {
+		if j < 0 || j >= len(mp.Idx) {
+			continue
+		}
+
+		small, large := i, j
+		if small > large {
+			small, large = large, small
+		}
+		if large-small > 1 {
+			marks[small+1]++
+			marks[large]--
+		}
+	}
+
+	counts := make([]int, len(mp.Idx))
+	var crossing int
+	for i := range counts {
+		crossing += marks[i]
+		counts[i] = crossing
+	}
+	return counts
+}
+
+// correctedArcCurve computes the FLUSS corrected arc curve by normalizing the arc
+// counts against the parabolic arc curve expected from a series with no regime
+// changes, capped at 1. The first and last factor*m positions are set to 1 since
+// few arcs can cross near the edges, which would otherwise look like boundaries.
+// With a factor of 0 the curve matches the one returned by the library's Segment,
+// which only sets the first and last positions to 1.
+func correctedArcCurve(mp matrixprofile.MatrixProfile, factor int) ([]float64, error) {
+	if factor < 0 {
+		return nil, errors.New("FLUSS exclusion factor must not be negative")
+	}
+
+	counts := arcCounts(mp)
+	n := float64(len(counts))
+	cac := make([]float64, len(counts))
+	for i, ac := range counts {
+		iac := 2 * float64(i) * (n - float64(i)) / n
+		cac[i] = 1
+		if iac > 0 && float64(ac) < iac {
+			cac[i] = float64(ac) / iac
+		}
+	}
+
+	edge := factor * mp.M
+	if edge < 1 {
+		edge = 1
+	}
+	for i := 0; i < edge && i < len(cac); i++ {
+		cac[i] = 1
+		cac[len(cac)-1-i] = 1
+	}
+
+	return cac, nil
+}
+
+func getSegments(c *gin.Context) {
+	start := time.Now()
+	endpoint := "/api/v1/segments"
+	method := "GET"
+	session := sessions.Default(c)
+	buildCORSHeaders(c)
+
+	factor, err := strconv.Atoi(c.DefaultQuery("factor", strconv.Itoa(defaultFlussFactor)))
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	v := fetchMPCache(session)
+	var mp matrixprofile.MatrixProfile
+	if v == nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{
+			Error:        errors.New("matrix profile is not initialized to compute segments"),
+			CacheExpired: true,
+		})
+		return
+	} else {
+		mp = v.(matrixprofile.MatrixProfile)
+	}
+
+	cac, err := correctedArcCurve(mp, factor)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	requestTotal.WithLabelValues(method, endpoint, "200").Inc()
+	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+	c.JSON(200, Segments{
+		M:         mp.M,
+		Algorithm: fetchComputeParams(session).Algorithm,
+		Factor:    factor,
+		CAC:       cac,
+	})
+}
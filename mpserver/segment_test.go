@@ -0,0 +1,69 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/aouyang1/go-matrixprofile/matrixprofile"
+)
+
+func TestArcCounts(t *testing.T) {
+	testData := []struct {
+		idx      []int
+		expected []int
+	}{
+		{[]int{}, []int{}},
+		// arcs between neighbors cross nothing
+		{[]int{1, 0, 3, 2}, []int{0, 0, 0, 0}},
+		{[]int{4, 3, 4, 1, 0}, []int{0, 2, 4, 3, 0}},
+		// out of range neighbors, as left by an uncomputed profile, are ignored
+		{[]int{-1, 3, math.MaxInt64, 0}, []int{0, 1, 2, 0}},
+	}
+
+	for _, d := range testData {
+		counts := arcCounts(matrixprofile.MatrixProfile{Idx: d.idx})
+		if len(counts) != len(d.expected) {
+			t.Fatalf("expected %d counts for %v but got %d", len(d.expected), d.idx, len(counts))
+		}
+		for i := range counts {
+			if counts[i] != d.expected[i] {
+				t.Errorf("expected arc counts %v for %v but got %v", d.expected, d.idx, counts)
+				break
+			}
+		}
+	}
+}
+
+func TestCorrectedArcCurveMatchesSegment(t *testing.T) {
+	// a sine wave that changes period halfway through has a clear regime change
+	data := make([]float64, 400)
+	for i := range data {
+		period := 20.0
+		if i >= len(data)/2 {
+			period = 35
+		}
+		data[i] = math.Sin(2*math.Pi*float64(i)/period) + 0.01*math.Sin(float64(i*i))
+	}
+
+	mp, err := matrixprofile.New(data, nil, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mp.Stomp(1); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, expected := mp.Segment()
+	cac, err := correctedArcCurve(*mp, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cac) != len(expected) {
+		t.Fatalf("expected %d values but got %d", len(expected), len(cac))
+	}
+	for i := range cac {
+		if math.Abs(cac[i]-expected[i]) > 1e-9 {
+			t.Errorf("expected %f at index %d but got %f", expected[i], i, cac[i])
+		}
+	}
+}
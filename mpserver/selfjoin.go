@@ -0,0 +1,374 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/aouyang1/go-matrixprofile/matrixprofile"
+	"github.com/gin-gonic/gin"
+)
+
+// selfJoinAlgorithm is the name reported for profiles computed by selfJoin
+// rather than the library's STOMP
+const selfJoinAlgorithm = "selfjoin"
+
+// metrics supported by selfJoin
+const (
+	euclideanMetric = "euclidean"
+	hammingMetric   = "hamming"
+)
+
+// defaultSelfJoinK is the number of motifs and discords returned from a self
+// join when k is not provided
+const defaultSelfJoinK = 3
+
+// SelfJoin is the result of a self join computed in the server. MP and Idx have
+// an entry for each subsequence. Inactive subsequences, such as those that
+// overlap the mask, have a null distance and an index of -1, as do active ones
+// that had no active subsequence to compare with. Motifs are the closest pairs
+// of subsequences and Discords the subsequences furthest from their nearest
+// neighbor, both taken from the active subsequences only.
+type SelfJoin struct {
+	M         int          `json:"m"`
+	Algorithm string       `json:"algorithm"`
+	Metric    string       `json:"metric"`
+	MP        []*float64   `json:"mp"`
+	Idx       []int        `json:"idx"`
+	Motifs    []MotifGroup `json:"motifs"`
+	Discords  []int        `json:"discords"`
+}
+
+// selfJoinOptions restrict which subsequences take part in a self join and how
+// they are compared. Mask, if set, has an entry for every point of the series
+// and any subsequence that overlaps a true entry is inactive. Metric is one of
+// euclideanMetric, the default, or hammingMetric.
+//
+// Band, if positive, restricts the neighbors of subsequence i to those j with
+// |i-j| <= Band. The band includes the exclusion zone, so only neighbors with
+// exzone < |i-j| <= Band are searched and Band must be larger than the zone.
+// Each entry of a banded profile is then the best local match within Band
+// samples rather than the best match anywhere in the series.
+//
+// MinStd makes subsequences whose standard deviation is below it inactive, to
+// leave out flat stretches such as idle or saturated sensors whose z-normalized
+// distances are dominated by noise. It is in the same units as the series, as the
+// population standard deviation of the values in the window, and only applies to
+// the euclidean metric.
+//
+// Imag, if set, is the imaginary part of a complex series, such as the Q samples
+// of an I/Q signal, whose real part is the series joined. It only applies to the
+// euclidean metric. See selfJoin for the distance between complex subsequences.
+type selfJoinOptions struct {
+	Mask   []bool
+	Metric string
+	Band   int
+	MinStd float64
+	Imag   []float64
+}
+
+// activeSubsequences reports for each subsequence whether it takes part in the
+// join. With the euclidean metric subsequences with no variance are always
+// inactive since they have no z-normalized distance to anything, as are those
+// below MinStd.
+func activeSubsequences(n, m int, std []float64, opts selfJoinOptions) []bool {
+	active := make([]bool, n)
+	for i := range active {
+		active[i] = opts.Metric == hammingMetric || std[i] != 0 && std[i] >= opts.MinStd
+	}
+
+	if opts.Mask != nil {
+		// masked[i] counts the masked points before i so a window's count is a
+		// difference of two entries
+		masked := make([]int, len(opts.Mask)+1)
+		for i, b := range opts.Mask {
+			masked[i+1] = masked[i]
+			if b {
+				masked[i+1]++
+			}
+		}
+		for i := range active {
+			if masked[i+m]-masked[i] > 0 {
+				active[i] = false
+			}
+		}
+	}
+	return active
+}
+
+// selfJoin computes the self join of the series with the library's exclusion
+// zone, leaving inactive subsequences out both as queries and as neighbors.
+// Their distance is NaN and their index -1. Active subsequences that had nothing
+// to compare with are infinite with an index of -1.
+//
+// The euclidean metric is the z-normalized euclidean distance the library uses.
+// A complex subsequence x is z-normalized as (x-mu)/sigma, where mu is its
+// complex mean and sigma the square root of the mean of |x_k-mu|^2, which is
+// the combined standard deviation of its real and imaginary parts. The distance
+// is the euclidean norm of the difference of two normalized subsequences,
+// sqrt(2m(1-Re(<x,y>)/m)) with <x,y> the hermitian inner product. This is the
+// same as joining the real and imaginary parts together as one real vector
+// normalized with a shared scale, so a subsequence matches a scaled and offset
+// copy of itself but not a phase rotated one. The hamming metric is for categorical or integer coded series and counts the
+// positions at which two subsequences hold different values, without any
+// normalization, so distances range from 0 to m.
+//
+// The dot products, or mismatch counts, of each subsequence with the ones after
+// it are derived from the previous subsequence's as STOMP does, so the join is
+// O(n^2) after the O(n*m) first row and every row only visits the pairs it has
+// not seen yet. With a band only the pairs within it are visited, which makes
+// the join O(n*Band). The FFT the library uses to speed up its first row only
+// applies to dot products, so it is not used for either metric.
+func selfJoin(a []float64, m int, opts selfJoinOptions) ([]float64, []int, error) {
+	if m < 2 {
+		return nil, nil, errors.New("window size must be at least 2")
+	}
+	if len(a) <= m {
+		return nil, nil, fmt.Errorf("series must be longer than the window size of %d", m)
+	}
+	if opts.Mask != nil && len(opts.Mask) != len(a) {
+		return nil, nil, fmt.Errorf("mask must have an entry for each of the %d points of the series", len(a))
+	}
+
+	exzone := profileExclusionZone(m)
+	if opts.Band < 0 || opts.Band > 0 && opts.Band <= exzone {
+		return nil, nil, fmt.Errorf("band must be larger than the exclusion zone of %d", exzone)
+	}
+
+	if !(opts.MinStd >= 0) {
+		return nil, nil, errors.New("minimum standard deviation must not be negative")
+	}
+	if opts.MinStd > 0 && opts.Metric == hammingMetric {
+		return nil, nil, errors.New("minimum standard deviation only applies to the euclidean metric")
+	}
+	if opts.Imag != nil && len(opts.Imag) != len(a) {
+		return nil, nil, fmt.Errorf("imaginary part must have an entry for each of the %d points of the series", len(a))
+	}
+	if opts.Imag != nil && opts.Metric == hammingMetric {
+		return nil, nil, errors.New("complex series only apply to the euclidean metric")
+	}
+
+	// pair is the contribution of the points at x and y to qt below
+	var pair func(x, y int) float64
+	switch {
+	case opts.Metric == hammingMetric:
+		pair = func(x, y int) float64 {
+			if a[x] != a[y] {
+				return 1
+			}
+			return 0
+		}
+	case opts.Metric != "" && opts.Metric != euclideanMetric:
+		return nil, nil, errors.New("invalid metric " + opts.Metric)
+	case opts.Imag != nil:
+		// the real part of the hermitian inner product
+		pair = func(x, y int) float64 { return a[x]*a[y] + opts.Imag[x]*opts.Imag[y] }
+	default:
+		pair = func(x, y int) float64 { return a[x] * a[y] }
+	}
+
+	n := len(a) - m + 1
+	mean, std := movMeanStd(a, m)
+	var meanImag []float64
+	if opts.Imag != nil {
+		var stdImag []float64
+		meanImag, stdImag = movMeanStd(opts.Imag, m)
+		for i := range std {
+			std[i] = math.Hypot(std[i], stdImag[i])
+		}
+	}
+	active := activeSubsequences(n, m, std, opts)
+
+	dist := make([]float64, n)
+	idx := make([]int, n)
+	for i := range dist {
+		dist[i] = math.Inf(1)
+		if !active[i] {
+			dist[i] = math.NaN()
+		}
+		idx[i] = -1
+	}
+
+	// qt[j] is the sum of pair over the positions of the current subsequence and
+	// subsequence j, kept for j from the current subsequence to the end of its
+	// band. The band of the previous subsequence ends one sample earlier, so it
+	// covers every qt[j-1] needed below.
+	qt := make([]float64, n)
+	for q := 0; q < n; q++ {
+		end := n
+		if opts.Band > 0 && q+opts.Band+1 < n {
+			end = q + opts.Band + 1
+		}
+
+		if q == 0 {
+			for j := 0; j < end; j++ {
+				for k := 0; k < m; k++ {
+					qt[j] += pair(k, j+k)
+				}
+			}
+		} else {
+			// iterate downwards so qt[j-1] still belongs to the previous row
+			for j := end - 1; j >= q; j-- {
+				qt[j] = qt[j-1] - pair(q-1, j-1) + pair(q+m-1, j+m-1)
+			}
+		}
+
+		if !active[q] {
+			continue
+		}
+		for j := q + exzone + 1; j < end; j++ {
+			if !active[j] {
+				continue
+			}
+			d := qt[j]
+			if opts.Metric != hammingMetric {
+				meanProd := mean[q] * mean[j]
+				if meanImag != nil {
+					meanProd += meanImag[q] * meanImag[j]
+				}
+				d = corrDistance(qt[j], meanProd, std[q]*std[j], m)
+			}
+			if d < dist[q] {
+				dist[q], idx[q] = d, j
+			}
+			if d < dist[j] {
+				dist[j], idx[j] = d, q
+			}
+		}
+	}
+
+	return dist, idx, nil
+}
+
+// motifPairs returns up to k motifs from a profile as the pairs of a subsequence
+// and its nearest neighbor, in order of increasing distance. A pair is skipped if
+// either member is within exzone of a member of an earlier pair.
+func motifPairs(dist []float64, idx []int, k, exzone int) []MotifGroup {
+	order := make([]int, 0, len(dist))
+	for i, d := range dist {
+		if isFinite(d) {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return dist[order[i]] < dist[order[j]]
+	})
+
+	var taken []int
+	near := func(i int) bool {
+		for _, t := range taken {
+			if i-t <= exzone && t-i <= exzone {
+				return true
+			}
+		}
+		return false
+	}
+
+	pairs := make([]MotifGroup, 0, k)
+	for _, i := range order {
+		if len(pairs) == k {
+			break
+		}
+		j := idx[i]
+		if near(i) || near(j) {
+			continue
+		}
+		pairs = append(pairs, MotifGroup{Idx: []int{i, j}, MinDist: dist[i]})
+		taken = append(taken, i, j)
+	}
+	return pairs
+}
+
+func selfJoinMP(c *gin.Context) {
+	start := time.Now()
+	endpoint := "/api/v1/selfjoin"
+	method := "POST"
+	buildCORSHeaders(c)
+
+	// the series is either sent as data or fetched from a source
+	params := struct {
+		Data   []float64 `json:"data"`
+		Source string    `json:"source"`
+		M      int       `json:"m"`
+		K      int       `json:"k"`
+		Mask   []bool    `json:"mask"`
+		Metric string    `json:"metric"`
+		// Band restricts neighbors to within this many samples, 0 for no limit
+		Band int `json:"band"`
+		// MinStd leaves out subsequences whose standard deviation, in the units of
+		// the series, is below it
+		MinStd float64 `json:"min_std"`
+		// Imag is the imaginary part of a complex series whose real part is the
+		// data or source
+		Imag []float64 `json:"imag"`
+	}{}
+	if err := c.BindJSON(&params); err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+	if len(params.Data) > 0 && params.Source != "" {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: errors.New("only one of data or source can be provided")})
+		return
+	}
+	series := params.Data
+	if params.Source != "" {
+		data, err := fetchData(params.Source)
+		if err != nil {
+			requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+			serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+			c.JSON(500, RespError{Error: err})
+			return
+		}
+		series = data.Data
+	}
+	k := params.K
+	if k <= 0 {
+		k = defaultSelfJoinK
+	}
+	metric := params.Metric
+	if metric == "" {
+		metric = euclideanMetric
+	}
+
+	dist, idx, err := selfJoin(series, params.M, selfJoinOptions{
+		Mask:   params.Mask,
+		Metric: metric,
+		Band:   params.Band,
+		MinStd: params.MinStd,
+		Imag:   params.Imag,
+	})
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+	computeTotal.WithLabelValues("user").Inc()
+
+	exzone := exclusionZone(params.M)
+	discords, err := findDiscords(matrixprofile.MatrixProfile{M: params.M, MP: dist}, k, exzone, exzone)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	requestTotal.WithLabelValues(method, endpoint, "200").Inc()
+	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+	c.JSON(200, SelfJoin{
+		M:         params.M,
+		Algorithm: selfJoinAlgorithm,
+		Metric:    metric,
+		MP:        alignToSeries(dist, len(dist)),
+		Idx:       idx,
+		Motifs:    motifPairs(dist, idx, k, exzone),
+		Discords:  discords,
+	})
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"testing"
+)
+
+func TestSelfJoinMatchesStomp(t *testing.T) {
+	mp := randomWalkMP(t, 300, 16)
+
+	dist, idx, err := selfJoin(mp.A, 16, selfJoinOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dist) != len(mp.MP) || len(idx) != len(mp.Idx) {
+		t.Fatalf("expected %d profile entries but got %d", len(mp.MP), len(dist))
+	}
+	for i := range mp.MP {
+		if math.Abs(dist[i]-mp.MP[i]) > 1e-6 {
+			t.Errorf("expected distance %f at %d but got %f", mp.MP[i], i, dist[i])
+		}
+	}
+}
+
+func TestSelfJoinMask(t *testing.T) {
+	mp := randomWalkMP(t, 300, 16)
+	mask := make([]bool, len(mp.A))
+	for i := 100; i < 120; i++ {
+		mask[i] = true
+	}
+
+	dist, idx, err := selfJoin(mp.A, 16, selfJoinOptions{Mask: mask})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range dist {
+		// subsequences 85 through 119 overlap the masked points
+		masked := i+16 > 100 && i < 120
+		if masked {
+			if !math.IsNaN(dist[i]) || idx[i] != -1 {
+				t.Errorf("expected masked subsequence %d to be NaN with index -1 but got %f, %d", i, dist[i], idx[i])
+			}
+			continue
+		}
+		if !isFinite(dist[i]) {
+			t.Errorf("expected a distance for subsequence %d but got %f", i, dist[i])
+		}
+		if idx[i]+16 > 100 && idx[i] < 120 {
+			t.Errorf("subsequence %d has the masked subsequence %d as its nearest neighbor", i, idx[i])
+		}
+		// no closer neighbor was left out other than masked ones
+		if mp.MP[i] > dist[i]+1e-6 {
+			t.Errorf("expected a distance of at least %f at %d but got %f", mp.MP[i], i, dist[i])
+		}
+	}
+
+	motifs := motifPairs(dist, idx, 3, 8)
+	for _, g := range motifs {
+		for _, j := range g.Idx {
+			if j+16 > 100 && j < 120 {
+				t.Errorf("masked subsequence %d reported as a motif", j)
+			}
+		}
+	}
+}
+
+func TestSelfJoinHamming(t *testing.T) {
+	// a sequence of states with runs, where constant windows are valid
+	r := rand.New(rand.NewSource(4))
+	a := make([]float64, 200)
+	for i := 1; i < len(a); i++ {
+		a[i] = a[i-1]
+		if r.Intn(4) == 0 {
+			a[i] = float64(r.Intn(5))
+		}
+	}
+	const m = 10
+
+	dist, idx, err := selfJoin(a, m, selfJoinOptions{Metric: hammingMetric})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exzone := profileExclusionZone(m)
+	for i := range dist {
+		expected := math.Inf(1)
+		for j := 0; j < len(dist); j++ {
+			if j-i <= exzone && i-j <= exzone {
+				continue
+			}
+			var mismatches float64
+			for k := 0; k < m; k++ {
+				if a[i+k] != a[j+k] {
+					mismatches++
+				}
+			}
+			expected = math.Min(expected, mismatches)
+		}
+		if dist[i] != expected {
+			t.Errorf("expected %f mismatches at %d but got %f", expected, i, dist[i])
+		}
+		if j := idx[i]; j < 0 || j-i <= exzone && i-j <= exzone {
+			t.Errorf("expected a neighbor outside the exclusion zone of %d but got %d", i, j)
+		}
+	}
+}
+
+func TestSelfJoinBand(t *testing.T) {
+	mp := randomWalkMP(t, 300, 16)
+	const band = 40
+
+	dist, idx, err := selfJoin(mp.A, 16, selfJoinOptions{Band: band})
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, _, err := selfJoin(mp.A, 16, selfJoinOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exzone := profileExclusionZone(16)
+	mean, std := movMeanStd(mp.A, 16)
+	dp := make([]float64, len(dist))
+	for i := range dist {
+		fillDistanceProfile(dp, mp.A, 16, mean, std, i)
+		expected := math.Inf(1)
+		for j, d := range dp {
+			if j-i > exzone && j-i <= band || i-j > exzone && i-j <= band {
+				expected = math.Min(expected, d)
+			}
+		}
+		if math.Abs(dist[i]-expected) > 1e-6 {
+			t.Errorf("expected banded distance %f at %d but got %f", expected, i, dist[i])
+		}
+		if j := idx[i]; j-i > band || i-j > band || j-i <= exzone && i-j <= exzone {
+			t.Errorf("expected a neighbor of %d within the band but got %d", i, j)
+		}
+		// a local match is never better than the best match anywhere
+		if dist[i] < full[i]-1e-6 {
+			t.Errorf("banded distance %f at %d is below the full join's %f", dist[i], i, full[i])
+		}
+	}
+}
+
+func TestSelfJoinMinStd(t *testing.T) {
+	// a random walk with an idle stretch of small noise
+	r := rand.New(rand.NewSource(5))
+	a := make([]float64, 300)
+	for i := 1; i < len(a); i++ {
+		a[i] = a[i-1] + r.NormFloat64()
+		if i >= 120 && i < 180 {
+			a[i] = a[119] + 0.001*r.NormFloat64()
+		}
+	}
+	const m, minStd = 16, 0.1
+
+	dist, idx, err := selfJoin(a, m, selfJoinOptions{MinStd: minStd})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exzone := profileExclusionZone(m)
+	mean, std := movMeanStd(a, m)
+	dp := make([]float64, len(dist))
+	var inactive int
+	for i := range dist {
+		if std[i] < minStd {
+			inactive++
+			if !math.IsNaN(dist[i]) || idx[i] != -1 {
+				t.Errorf("expected inactive subsequence %d to be NaN with index -1 but got %f, %d", i, dist[i], idx[i])
+			}
+			continue
+		}
+
+		fillDistanceProfile(dp, a, m, mean, std, i)
+		expected := math.Inf(1)
+		for j, d := range dp {
+			if std[j] >= minStd && (j-i > exzone || i-j > exzone) {
+				expected = math.Min(expected, d)
+			}
+		}
+		if math.Abs(dist[i]-expected) > 1e-6 {
+			t.Errorf("expected distance %f at %d but got %f", expected, i, dist[i])
+		}
+		if std[idx[i]] < minStd {
+			t.Errorf("subsequence %d has the inactive subsequence %d as its nearest neighbor", i, idx[i])
+		}
+	}
+	if inactive == 0 {
+		t.Fatal("expected the idle stretch to leave inactive subsequences")
+	}
+}
+
+// complexZNormalize z-normalizes a complex subsequence by its complex mean and
+// the square root of its mean squared deviation
+func complexZNormalize(x []complex128) []complex128 {
+	var mu complex128
+	for _, v := range x {
+		mu += v
+	}
+	mu /= complex(float64(len(x)), 0)
+
+	var ss float64
+	for _, v := range x {
+		ss += math.Pow(cmplx.Abs(v-mu), 2)
+	}
+	sigma := math.Sqrt(ss / float64(len(x)))
+
+	out := make([]complex128, len(x))
+	for i, v := range x {
+		out[i] = (v - mu) / complex(sigma, 0)
+	}
+	return out
+}
+
+func TestSelfJoinComplex(t *testing.T) {
+	// a random walk in the complex plane
+	r := rand.New(rand.NewSource(6))
+	re := make([]float64, 200)
+	im := make([]float64, 200)
+	for i := 1; i < len(re); i++ {
+		re[i] = re[i-1] + r.NormFloat64()
+		im[i] = im[i-1] + r.NormFloat64()
+	}
+	const m = 12
+
+	dist, idx, err := selfJoin(re, m, selfJoinOptions{Imag: im})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := len(re) - m + 1
+	z := make([][]complex128, n)
+	for i := range z {
+		x := make([]complex128, m)
+		for k := range x {
+			x[k] = complex(re[i+k], im[i+k])
+		}
+		z[i] = complexZNormalize(x)
+	}
+
+	exzone := profileExclusionZone(m)
+	for i := range dist {
+		expected := math.Inf(1)
+		for j := range z {
+			if j-i <= exzone && i-j <= exzone {
+				continue
+			}
+			var ss float64
+			for k := range z[i] {
+				ss += math.Pow(cmplx.Abs(z[i][k]-z[j][k]), 2)
+			}
+			expected = math.Min(expected, math.Sqrt(ss))
+		}
+		if math.Abs(dist[i]-expected) > 1e-6 {
+			t.Errorf("expected distance %f at %d but got %f", expected, i, dist[i])
+		}
+		if idx[i] < 0 || idx[i] >= n {
+			t.Errorf("expected a neighbor for %d but got %d", i, idx[i])
+		}
+	}
+}
+
+func TestSelfJoinComplexRealSeries(t *testing.T) {
+	// a series with no imaginary part joins exactly like the real series
+	mp := randomWalkMP(t, 200, 16)
+	dist, _, err := selfJoin(mp.A, 16, selfJoinOptions{Imag: make([]float64, len(mp.A))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range mp.MP {
+		if math.Abs(dist[i]-mp.MP[i]) > 1e-6 {
+			t.Errorf("expected distance %f at %d but got %f", mp.MP[i], i, dist[i])
+		}
+	}
+}
+
+func TestSelfJoinComplexPhase(t *testing.T) {
+	// the second half repeats the first rotated by 90 degrees, which is not a
+	// match, and the third repeats it scaled and offset, which is
+	r := rand.New(rand.NewSource(7))
+	const half = 60
+	re := make([]float64, 3*half)
+	im := make([]float64, 3*half)
+	for i := 1; i < half; i++ {
+		re[i] = re[i-1] + r.NormFloat64()
+		im[i] = im[i-1] + r.NormFloat64()
+	}
+	for i := 0; i < half; i++ {
+		re[half+i], im[half+i] = -im[i], re[i]
+		re[2*half+i], im[2*half+i] = 3*re[i]+5, 3*im[i]-2
+	}
+
+	dist, idx, err := selfJoin(re, 10, selfJoinOptions{Imag: im})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dist[5] > 1e-6 || idx[5] != 2*half+5 {
+		t.Errorf("expected subsequence 5 to match its scaled copy at %d but got %d at %f", 2*half+5, idx[5], dist[5])
+	}
+}
+
+func TestSelfJoinInvalid(t *testing.T) {
+	a := make([]float64, 20)
+	for i := range a {
+		a[i] = float64(i % 3)
+	}
+	if _, _, err := selfJoin(a, 1, selfJoinOptions{}); err == nil {
+		t.Error("expected an error for a window size of 1")
+	}
+	if _, _, err := selfJoin(a, 20, selfJoinOptions{}); err == nil {
+		t.Error("expected an error for a window as long as the series")
+	}
+	if _, _, err := selfJoin(a, 4, selfJoinOptions{Mask: make([]bool, 5)}); err == nil {
+		t.Error("expected an error for a mask shorter than the series")
+	}
+	if _, _, err := selfJoin(a, 4, selfJoinOptions{Metric: "cosine"}); err == nil {
+		t.Error("expected an error for an unknown metric")
+	}
+	// the exclusion zone of a window of 4 is 2
+	if _, _, err := selfJoin(a, 4, selfJoinOptions{Band: 2}); err == nil {
+		t.Error("expected an error for a band within the exclusion zone")
+	}
+	if _, _, err := selfJoin(a, 4, selfJoinOptions{Band: -1}); err == nil {
+		t.Error("expected an error for a negative band")
+	}
+	if _, _, err := selfJoin(a, 4, selfJoinOptions{MinStd: -1}); err == nil {
+		t.Error("expected an error for a negative minimum standard deviation")
+	}
+	if _, _, err := selfJoin(a, 4, selfJoinOptions{MinStd: 0.1, Metric: hammingMetric}); err == nil {
+		t.Error("expected an error for a minimum standard deviation with the hamming metric")
+	}
+	if _, _, err := selfJoin(a, 4, selfJoinOptions{Imag: make([]float64, 5)}); err == nil {
+		t.Error("expected an error for an imaginary part shorter than the series")
+	}
+	if _, _, err := selfJoin(a, 4, selfJoinOptions{Imag: make([]float64, len(a)), Metric: hammingMetric}); err == nil {
+		t.Error("expected an error for a complex series with the hamming metric")
+	}
+}
+
+func TestMotifPairs(t *testing.T) {
+	inf := math.Inf(1)
+	dist := []float64{3, 1, math.NaN(), 2, 1, inf, 0.5, 4}
+	idx := []int{7, 4, -1, 6, 1, -1, 3, 0}
+
+	testData := []struct {
+		k        int
+		exzone   int
+		expected [][]int
+	}{
+		{1, 0, [][]int{{6, 3}}},
+		{3, 0, [][]int{{6, 3}, {1, 4}, {0, 7}}},
+		// 4 is within the zone of 3 and 7 within the zone of 6
+		{3, 1, [][]int{{6, 3}}},
+		{10, 0, [][]int{{6, 3}, {1, 4}, {0, 7}}},
+	}
+
+	for _, d := range testData {
+		pairs := motifPairs(dist, idx, d.k, d.exzone)
+		if len(pairs) != len(d.expected) {
+			t.Errorf("expected pairs %v with k=%d and exzone=%d but got %v", d.expected, d.k, d.exzone, pairs)
+			continue
+		}
+		for i, p := range pairs {
+			if p.Idx[0] != d.expected[i][0] || p.Idx[1] != d.expected[i][1] {
+				t.Errorf("expected pairs %v with k=%d and exzone=%d but got %v", d.expected, d.k, d.exzone, pairs)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/aouyang1/go-matrixprofile/matrixprofile"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultSparklineWidth  = 400
+	defaultSparklineHeight = 100
+	maxSparklineSize       = 2000
+
+	// sparklinePadding is the number of pixels left empty around the plot
+	sparklinePadding = 4
+)
+
+// sparklineColors are cycled through for each occurrence of the motif
+var sparklineColors = []color.RGBA{
+	{0x1f, 0x77, 0xb4, 0xff},
+	{0xff, 0x7f, 0x0e, 0xff},
+	{0x2c, 0xa0, 0x2c, 0xff},
+	{0xd6, 0x27, 0x28, 0xff},
+	{0x94, 0x67, 0xbd, 0xff},
+	{0x8c, 0x56, 0x4b, 0xff},
+}
+
+// renderSparkline overlays the series on a white background, scaled so that all
+// of them fit within the image. Every series must have the same length.
+func renderSparkline(series [][]float64, width, height int) (*image.RGBA, error) {
+	if len(series) == 0 || len(series[0]) < 2 {
+		return nil, errors.New("need at least one series of two or more points to render")
+	}
+	if width <= 2*sparklinePadding || height <= 2*sparklinePadding {
+		return nil, fmt.Errorf("image must be larger than %dx%d", 2*sparklinePadding, 2*sparklinePadding)
+	}
+
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, s := range series {
+		for _, v := range s {
+			lo = math.Min(lo, v)
+			hi = math.Max(hi, v)
+		}
+	}
+	if hi == lo {
+		hi = lo + 1
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+
+	xScale := float64(width-2*sparklinePadding-1) / float64(len(series[0])-1)
+	yScale := float64(height-2*sparklinePadding-1) / (hi - lo)
+	point := func(j int, v float64) (int, int) {
+		x := sparklinePadding + int(math.Round(float64(j)*xScale))
+		y := height - 1 - sparklinePadding - int(math.Round((v-lo)*yScale))
+		return x, y
+	}
+
+	for i, s := range series {
+		col := sparklineColors[i%len(sparklineColors)]
+		x0, y0 := point(0, s[0])
+		for j := 1; j < len(s); j++ {
+			x1, y1 := point(j, s[j])
+			drawLine(img, x0, y0, x1, y1, col)
+			x0, y0 = x1, y1
+		}
+	}
+
+	return img, nil
+}
+
+// drawLine draws a one pixel wide line between two points using Bresenham's
+// algorithm
+func drawLine(img *image.RGBA, x0, y0, x1, y1 int, col color.RGBA) {
+	dx := x1 - x0
+	if dx < 0 {
+		dx = -dx
+	}
+	dy := y1 - y0
+	if dy > 0 {
+		dy = -dy
+	}
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+
+	e := dx + dy
+	for {
+		img.SetRGBA(x0, y0, col)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			e += dx
+			y0 += sy
+		}
+	}
+}
+
+// getMotifPNG renders the z-normalized occurrences of the k-th best motif as a PNG
+// sparkline for quick sharing without the frontend
+func getMotifPNG(c *gin.Context) {
+	start := time.Now()
+	endpoint := "/api/v1/motif.png"
+	method := "GET"
+	session := sessions.Default(c)
+	buildCORSHeaders(c)
+
+	k, err := strconv.Atoi(c.DefaultQuery("k", "1"))
+	if err == nil && k < 1 {
+		err = errors.New("k must be at least 1")
+	}
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	r, err := strconv.ParseFloat(c.DefaultQuery("r", "2"), 64)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	width, err := strconv.Atoi(c.DefaultQuery("width", strconv.Itoa(defaultSparklineWidth)))
+	if err == nil && width > maxSparklineSize {
+		err = fmt.Errorf("width cannot exceed %d", maxSparklineSize)
+	}
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	height, err := strconv.Atoi(c.DefaultQuery("height", strconv.Itoa(defaultSparklineHeight)))
+	if err == nil && height > maxSparklineSize {
+		err = fmt.Errorf("height cannot exceed %d", maxSparklineSize)
+	}
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	v := fetchMPCache(session)
+
+	var mp matrixprofile.MatrixProfile
+	if v == nil {
+		// either the cache expired or this was called directly
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{
+			Error:        errors.New("matrix profile is not initialized to render motifs"),
+			CacheExpired: true,
+		})
+		return
+	} else {
+		mp = v.(matrixprofile.MatrixProfile)
+	}
+
+	// m is optional and only guards against rendering a profile other than the
+	// one the caller expects
+	if m := c.Query("m"); m != "" && m != strconv.Itoa(mp.M) {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: fmt.Errorf("matrix profile was computed with m=%d, not %s", mp.M, m)})
+		return
+	}
+
+	motifGroups, err := mp.TopKMotifs(k, r)
+	if err == nil && len(motifGroups) < k {
+		err = fmt.Errorf("only %d motifs were found", len(motifGroups))
+	}
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	idxs, _ := removeTrivialMatches(motifGroups[k-1].Idx, exclusionZone(mp.M))
+	series := make([][]float64, 0, len(idxs))
+	for _, idx := range idxs {
+		subseq, err := subsequence(mp, idx)
+		if err != nil {
+			requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+			serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+			c.JSON(500, RespError{Error: err})
+			return
+		}
+		norm, err := matrixprofile.ZNormalize(subseq)
+		if err != nil {
+			requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+			serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+			c.JSON(500, RespError{Error: err})
+			return
+		}
+		series = append(series, norm)
+	}
+
+	img, err := renderSparkline(series, width, height)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	requestTotal.WithLabelValues(method, endpoint, "200").Inc()
+	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+	c.Data(200, "image/png", buf.Bytes())
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/aouyang1/go-matrixprofile/matrixprofile"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// StreamDiscord is a newly appended subsequence whose distance to its nearest
+// neighbor exceeded the requested threshold
+type StreamDiscord struct {
+	Idx      int     `json:"idx"`
+	Distance float64 `json:"distance"`
+}
+
+// StreamUpdate is the part of the session's matrix profile that changed after
+// appending new points. MP and Idx hold the profile from Start to the end of the
+// series, which covers both the new subsequences and any existing ones whose
+// nearest neighbor is now one of the new subsequences.
+type StreamUpdate struct {
+	Start   int            `json:"start"`
+	MP      []*float64     `json:"mp"`
+	Idx     []int          `json:"idx"`
+	Discord *StreamDiscord `json:"discord"`
+	Events  []StreamEvent  `json:"events"`
+}
+
+const (
+	eventNewGroup   = "new_group"
+	eventGrownGroup = "grown_group"
+	eventNewDiscord = "new_discord"
+)
+
+// StreamEvent is a change in the motifs or discords of the profile caused by an
+// append. Group is the position of the motif group in the current top k and
+// Members the occurrences that were not part of the group before the append.
+// For a new discord Members holds the discord's index.
+type StreamEvent struct {
+	Type    string `json:"type"`
+	Group   int    `json:"group"`
+	Members []int  `json:"members"`
+}
+
+// motifSnapshot is the top k motifs of the session's profile after the last
+// tracked append. The snapshot is dropped whenever the profile is replaced, and N
+// is the profile length it was taken at so that a snapshot is not diffed against
+// a profile that was changed without it. K and R are the TopKMotifs arguments it
+// was taken with, since groups found with different ones are not comparable.
+type motifSnapshot struct {
+	N      int          `json:"n"`
+	M      int          `json:"m"`
+	K      int          `json:"k"`
+	R      float64      `json:"r"`
+	Groups []MotifGroup `json:"groups"`
+}
+
+// fetchMotifSnapshot returns the session's motif snapshot if it was taken of a
+// profile with n subsequences and window m using the same k and r
+func fetchMotifSnapshot(session sessions.Session, n, m, k int, r float64) *motifSnapshot {
+	b, ok := session.Get("motifs").([]byte)
+	if !ok {
+		return nil
+	}
+	var snap motifSnapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return nil
+	}
+	if snap.N != n || snap.M != m || snap.K != k || snap.R != r {
+		return nil
+	}
+	return &snap
+}
+
+// diffMotifs reports the groups in cur that did not exist in prev and the groups
+// that gained occurrences. A current group is the same as a previous group if
+// they share an occurrence within the exclusion zone, and an occurrence is new if
+// it is not within the exclusion zone of an occurrence of the previous group.
+// Without a previous snapshot every group is reported as new.
+func diffMotifs(prev *motifSnapshot, cur []MotifGroup, exzone int) []StreamEvent {
+	near := func(idx int, idxs []int) bool {
+		for _, j := range idxs {
+			if idx-j <= exzone && j-idx <= exzone {
+				return true
+			}
+		}
+		return false
+	}
+
+	var events []StreamEvent
+	for i, g := range cur {
+		var match []int
+		if prev != nil {
+			for _, p := range prev.Groups {
+				for _, idx := range g.Idx {
+					if near(idx, p.Idx) {
+						match = p.Idx
+						break
+					}
+				}
+				if match != nil {
+					break
+				}
+			}
+		}
+
+		if match == nil {
+			events = append(events, StreamEvent{Type: eventNewGroup, Group: i, Members: g.Idx})
+			continue
+		}
+
+		var added []int
+		for _, idx := range g.Idx {
+			if !near(idx, match) {
+				added = append(added, idx)
+			}
+		}
+		if len(added) > 0 {
+			events = append(events, StreamEvent{Type: eventGrownGroup, Group: i, Members: added})
+		}
+	}
+	return events
+}
+
+// appendMP appends the new points to the series of a self join matrix profile
+// and extends the profile over them, returning the first profile index that
+// changed. Only the distances between the new subsequences and the rest of the
+// series are computed. The first new subsequence takes a dot product over the
+// window with every other one, which is O(n*m), and each one after it derives
+// its dot products from the previous one's in O(n) as STOMP does. Only the
+// series, profile and index are updated, so the profile has to go through
+// matrixprofile.New before any of the library's methods are called on it.
+func appendMP(mp *matrixprofile.MatrixProfile, data []float64) (int, error) {
+	m := mp.M
+	prevN := len(mp.MP)
+	if m < 2 || prevN != len(mp.A)-m+1 || len(mp.Idx) != prevN {
+		return 0, errors.New("matrix profile does not match its series")
+	}
+
+	a := make([]float64, 0, len(mp.A)+len(data))
+	a = append(append(a, mp.A...), data...)
+	n := len(a) - m + 1
+	mean, std := movMeanStd(a, m)
+	exzone := profileExclusionZone(m)
+
+	dist := append(mp.MP, make([]float64, n-prevN)...)
+	idx := append(mp.Idx, make([]int, n-prevN)...)
+	for i := prevN; i < n; i++ {
+		dist[i] = math.Inf(1)
+		idx[i] = math.MaxInt64
+	}
+
+	// qt[j] is the dot product of the current subsequence with subsequence j
+	qt := make([]float64, n)
+	changed := prevN
+	for q := prevN; q < n; q++ {
+		if q == prevN {
+			for j := 0; j <= q; j++ {
+				qt[j] = dot(a[q:q+m], a[j:j+m])
+			}
+		} else {
+			// iterate downwards so qt[j-1] still belongs to the previous row
+			for j := q; j > 0; j-- {
+				qt[j] = qt[j-1] - a[q-1]*a[j-1] + a[q+m-1]*a[j+m-1]
+			}
+			qt[0] = dot(a[q:q+m], a[:m])
+		}
+
+		if std[q] == 0 {
+			// constant subsequences have no distance to anything
+			continue
+		}
+		// every earlier subsequence outside the exclusion zone, later ones are
+		// compared when their own row is computed
+		for j := 0; j < q-exzone; j++ {
+			if std[j] == 0 {
+				continue
+			}
+			d := corrDistance(qt[j], mean[q]*mean[j], std[q]*std[j], m)
+			if d < dist[q] {
+				dist[q], idx[q] = d, j
+			}
+			if d < dist[j] {
+				dist[j], idx[j] = d, q
+				if j < changed {
+					changed = j
+				}
+			}
+		}
+	}
+
+	mp.A, mp.B, mp.N = a, a, len(a)
+	mp.MP, mp.Idx = dist, idx
+	return changed, nil
+}
+
+// streamDiscord returns the appended subsequence furthest from its nearest
+// neighbor if that distance is above the threshold
+func streamDiscord(mp matrixprofile.MatrixProfile, from int, threshold float64) *StreamDiscord {
+	if from >= len(mp.MP) {
+		return nil
+	}
+	dist, idx := maxIgnoreNaN(mp.MP[from:])
+	if idx == -1 || dist <= threshold {
+		return nil
+	}
+	return &StreamDiscord{Idx: from + idx, Distance: dist}
+}
+
+func appendStream(c *gin.Context) {
+	start := time.Now()
+	endpoint := "/api/v1/stream/append"
+	method := "POST"
+	session := sessions.Default(c)
+	buildCORSHeaders(c)
+
+	params := struct {
+		Data []float64 `json:"data"`
+		// Threshold is the distance an appended subsequence must exceed to be
+		// reported as a discord. Nothing is reported when it is not set.
+		Threshold float64 `json:"threshold"`
+		// K and R are passed to TopKMotifs to track the motifs across appends.
+		// Motifs are not tracked when K is not set.
+		K int     `json:"k"`
+		R float64 `json:"r"`
+	}{}
+	if err := c.BindJSON(&params); err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+	if len(params.Data) == 0 {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: errors.New("no data points to append")})
+		return
+	}
+
+	// the profile is only decoded as stored since appendMP needs nothing else,
+	// and the library's fields are only rebuilt below if motifs are tracked
+	mp, ok := fetchStoredMPCache(session)
+	if !ok {
+		// either the cache expired or /calculate was never called
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{
+			Error:        errors.New("matrix profile is not initialized to append data"),
+			CacheExpired: true,
+		})
+		return
+	}
+
+	prevLen := len(mp.MP)
+	prevMotifs := fetchMotifSnapshot(session, prevLen, mp.M, params.K, params.R)
+	from, err := appendMP(&mp, params.Data)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+	computeTotal.WithLabelValues("stream").Inc()
+
+	update := StreamUpdate{
+		Start: from,
+		MP:    alignToSeries(mp.MP[from:], len(mp.MP)-from),
+		Idx:   mp.Idx[from:],
+	}
+	if params.Threshold > 0 {
+		update.Discord = streamDiscord(mp, prevLen, params.Threshold)
+		if update.Discord != nil {
+			update.Events = append(update.Events, StreamEvent{
+				Type:    eventNewDiscord,
+				Members: []int{update.Discord.Idx},
+			})
+		}
+	}
+
+	if params.K > 0 {
+		full, err := matrixprofile.New(mp.A, nil, mp.M)
+		if err != nil {
+			requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+			serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+			c.JSON(500, RespError{Error: err})
+			return
+		}
+		full.AV = mp.AV
+		full.MP = mp.MP
+		full.Idx = mp.Idx
+
+		motifGroups, err := full.TopKMotifs(params.K, params.R)
+		if err != nil {
+			requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+			serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+			c.JSON(500, RespError{Error: err})
+			return
+		}
+		for i, g := range motifGroups {
+			motifGroups[i].Idx, _ = removeTrivialMatches(g.Idx, exclusionZone(mp.M))
+		}
+
+		groups := toMotifGroups(motifGroups)
+		update.Events = append(update.Events, diffMotifs(prevMotifs, groups, exclusionZone(mp.M))...)
+
+		// saved along with the profile below
+		snap, err := json.Marshal(motifSnapshot{
+			N:      len(mp.MP),
+			M:      mp.M,
+			K:      params.K,
+			R:      params.R,
+			Groups: groups,
+		})
+		if err != nil {
+			requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+			serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+			c.JSON(500, RespError{Error: err})
+			return
+		}
+		session.Set("motifs", snap)
+	}
+
+	// the profile now covers a longer series, so the parameters recorded for it
+	// have to describe that series
+	computeParams := fetchComputeParams(session)
+	computeParams.InputLength = len(mp.A)
+	computeParams.InputHash = hashSeries(mp.A)
+	b, err := json.Marshal(computeParams)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+	session.Set("params", b)
+
+	if err := storeMPCache(session, &mp); err != nil {
+		code := cacheErrorCode(err)
+		requestTotal.WithLabelValues(method, endpoint, strconv.Itoa(code)).Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(code, RespError{Error: err})
+		return
+	}
+
+	requestTotal.WithLabelValues(method, endpoint, "200").Inc()
+	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+	c.JSON(200, update)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/aouyang1/go-matrixprofile/matrixprofile"
+)
+
+func TestAppendMPMatchesStomp(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	data := make([]float64, 260)
+	for i := 1; i < len(data); i++ {
+		data[i] = data[i-1] + r.NormFloat64()
+	}
+
+	const m = 12
+	mp, err := matrixprofile.New(data[:200], nil, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mp.Stomp(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// appends of a single point and of several at once
+	for _, end := range []int{201, 210, 260} {
+		prev := append([]float64(nil), mp.MP...)
+		prevIdx := append([]int(nil), mp.Idx...)
+		prevLen := len(mp.MP)
+
+		from, err := appendMP(mp, data[len(mp.A):end])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected, err := matrixprofile.New(data[:end], nil, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = expected.Stomp(1); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(mp.MP) != len(expected.MP) || len(mp.Idx) != len(expected.Idx) || len(mp.A) != end {
+			t.Fatalf("expected %d profile entries over %d points but got %d over %d", len(expected.MP), end, len(mp.MP), len(mp.A))
+		}
+		for i := range expected.MP {
+			if isFinite(expected.MP[i]) != isFinite(mp.MP[i]) ||
+				isFinite(expected.MP[i]) && math.Abs(expected.MP[i]-mp.MP[i]) > 1e-6 {
+				t.Errorf("expected distance %f at %d after appending up to %d but got %f", expected.MP[i], i, end, mp.MP[i])
+			}
+		}
+
+		// nothing before the reported start changed
+		if from > prevLen {
+			t.Errorf("expected the changes to start by %d but got %d", prevLen, from)
+		}
+		for i := 0; i < from; i++ {
+			if mp.MP[i] != prev[i] || mp.Idx[i] != prevIdx[i] {
+				t.Errorf("profile entry %d changed before the reported start %d", i, from)
+				break
+			}
+		}
+	}
+}
+
+func TestAppendMPMismatched(t *testing.T) {
+	mp := randomWalkMP(t, 50, 8)
+	mp.MP = mp.MP[:10]
+	if _, err := appendMP(mp, []float64{1, 2}); err == nil {
+		t.Error("expected an error for a profile that does not match its series")
+	}
+}
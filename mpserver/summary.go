@@ -0,0 +1,338 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aouyang1/go-matrixprofile/matrixprofile"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// MPSummary is an overview of the distribution of matrix profile distances. The
+// best motif distance is the smallest distance in the profile and the strongest
+// discord distance is the largest finite distance.
+type MPSummary struct {
+	M                 int     `json:"m"`
+	Algorithm         string  `json:"algorithm"`
+	Min               float64 `json:"min"`
+	Max               float64 `json:"max"`
+	Mean              float64 `json:"mean"`
+	Median            float64 `json:"median"`
+	NaNCount          int     `json:"nan_count"`
+	BestMotifDist     float64 `json:"best_motif_dist"`
+	StrongestDiscDist float64 `json:"strongest_discord_dist"`
+
+	// DominantPeriod is the most common spacing between a subsequence and its
+	// nearest neighbor, and PeriodConfidence the fraction of neighbors found at
+	// that spacing. Both are 0 when no period could be found.
+	DominantPeriod   int     `json:"dominant_period"`
+	PeriodConfidence float64 `json:"period_confidence"`
+}
+
+// summarize computes the summary statistics over the finite values of the matrix
+// profile. NaN and infinite entries are counted in NaNCount and otherwise ignored.
+func summarize(mp matrixprofile.MatrixProfile) (MPSummary, error) {
+	summary := MPSummary{M: mp.M}
+
+	finite := make([]float64, 0, len(mp.MP))
+	for _, d := range mp.MP {
+		if !isFinite(d) {
+			summary.NaNCount++
+			continue
+		}
+		finite = append(finite, d)
+	}
+	if len(finite) == 0 {
+		return summary, errors.New("matrix profile has no finite distances to summarize")
+	}
+
+	sort.Float64s(finite)
+
+	var sum float64
+	for _, d := range finite {
+		sum += d
+	}
+
+	summary.Min = finite[0]
+	summary.Max = finite[len(finite)-1]
+	summary.Mean = sum / float64(len(finite))
+	if len(finite)%2 == 0 {
+		summary.Median = (finite[len(finite)/2-1] + finite[len(finite)/2]) / 2
+	} else {
+		summary.Median = finite[len(finite)/2]
+	}
+	summary.BestMotifDist = summary.Min
+	summary.StrongestDiscDist = summary.Max
+
+	if period, confidence, err := dominantPeriod(mp); err == nil {
+		summary.DominantPeriod = period
+		summary.PeriodConfidence = confidence
+	}
+
+	return summary, nil
+}
+
+// dominantPeriodCandidates is the number of most common spacings considered as
+// the period by dominantPeriod
+const dominantPeriodCandidates = 10
+
+// dominantPeriod reports how often the main pattern repeats from the spacing
+// between each subsequence and its nearest neighbor. Spacings within the
+// exclusion zone are ignored. The nearest neighbor of a repeating pattern may be
+// any number of repetitions away, so candidate periods are scored by the
+// fraction of all spacings that land within a tenth of the window size of one of
+// their multiples, less the fraction expected by chance. The best scoring period
+// is returned with its score as a confidence between 0 and 1.
+func dominantPeriod(mp matrixprofile.MatrixProfile) (int, float64, error) {
+	counts := make(map[int]int)
+	var total int
+	for i, j := range mp.Idx {
+		if !isFinite(mp.MP[i]) || j < 0 || j >= len(mp.Idx) {
+			continue
+		}
+		spacing := j - i
+		if spacing < 0 {
+			spacing = -spacing
+		}
+		if spacing <= exclusionZone(mp.M) {
+			continue
+		}
+		counts[spacing]++
+		total++
+	}
+	if total == 0 {
+		return 0, 0, errors.New("matrix profile has no neighbors outside the exclusion zone")
+	}
+
+	tol := mp.M / 10
+	if tol < 1 {
+		tol = 1
+	}
+	// support is the number of spacings within tol of p, memoized since it is
+	// needed for every spacing while sorting and again for the candidates
+	supports := make(map[int]int, len(counts))
+	support := func(p int) int {
+		if n, ok := supports[p]; ok {
+			return n
+		}
+		var n int
+		for d := p - tol; d <= p+tol; d++ {
+			n += counts[d]
+		}
+		supports[p] = n
+		return n
+	}
+
+	spacings := make([]int, 0, len(counts))
+	for spacing := range counts {
+		spacings = append(spacings, spacing)
+		support(spacing)
+	}
+	sort.Slice(spacings, func(i, j int) bool {
+		si, sj := supports[spacings[i]], supports[spacings[j]]
+		if si != sj {
+			return si > sj
+		}
+		return spacings[i] < spacings[j]
+	})
+
+	// the fundamental may be rarer than its multiples, so the fractions of the
+	// most common spacings are also considered as long as neighbors were found
+	// near them
+	seen := make(map[int]bool)
+	var candidates []int
+	for i := 0; i < len(spacings) && i < dominantPeriodCandidates; i++ {
+		for k := 1; spacings[i]/k > exclusionZone(mp.M); k++ {
+			p := int(math.Round(float64(spacings[i]) / float64(k)))
+			if !seen[p] && support(p) > 0 {
+				seen[p] = true
+				candidates = append(candidates, p)
+			}
+		}
+	}
+
+	var period int
+	var confidence, estimate float64
+	for _, p := range candidates {
+		var n int
+		var sum float64
+		for _, spacing := range spacings {
+			k := int(math.Round(float64(spacing) / float64(p)))
+			if k < 1 {
+				continue
+			}
+			diff := spacing - k*p
+			if diff < 0 {
+				diff = -diff
+			}
+			if diff <= tol {
+				n += counts[spacing]
+				sum += float64(counts[spacing]*spacing) / float64(k)
+			}
+		}
+		if n == 0 {
+			continue
+		}
+
+		// unrelated spacings still land near a multiple of p by chance, more so
+		// for short periods, so the score is how far above chance the matches are
+		chance := math.Min(float64(2*tol+1)/float64(p), 1)
+		score := 0.0
+		if chance < 1 {
+			score = (float64(n)/float64(total) - chance) / (1 - chance)
+		}
+		if score > confidence || (score == confidence && period != 0 && support(p) > support(period)) {
+			period, confidence = p, score
+			estimate = sum / float64(n)
+		}
+	}
+	if period == 0 {
+		return 0, 0, errors.New("matrix profile neighbors do not repeat at a regular spacing")
+	}
+
+	// candidates near the true period match nearly the same spacings, so the
+	// period is refined to the average spacing per repetition of the matches
+	period = int(math.Round(estimate))
+
+	return period, confidence, nil
+}
+
+type Histogram struct {
+	M         int       `json:"m"`
+	Algorithm string    `json:"algorithm"`
+	Counts    []int     `json:"counts"`
+	Edges     []float64 `json:"edges"`
+}
+
+// mpHistogram bins the finite matrix profile distances into equal width bins
+// between the smallest and largest distance. The returned edges have one more
+// entry than the counts, with the last bin including its upper edge. NaN and
+// infinite distances are ignored. There can be no more bins than distances in
+// the profile, which also bounds the allocations for a bins value taken from a
+// request.
+func mpHistogram(mp matrixprofile.MatrixProfile, bins int) ([]int, []float64, error) {
+	if bins < 1 {
+		return nil, nil, errors.New("number of histogram bins must be at least 1")
+	}
+	if bins > len(mp.MP) {
+		return nil, nil, fmt.Errorf("number of histogram bins cannot exceed the profile length of %d", len(mp.MP))
+	}
+
+	minDist, minIdx := minIgnoreNaN(mp.MP)
+	maxDist, _ := maxIgnoreNaN(mp.MP)
+	if minIdx < 0 {
+		return nil, nil, errors.New("matrix profile has no finite distances to bin")
+	}
+
+	width := (maxDist - minDist) / float64(bins)
+	edges := make([]float64, bins+1)
+	for i := range edges {
+		edges[i] = minDist + float64(i)*width
+	}
+	edges[bins] = maxDist
+
+	counts := make([]int, bins)
+	for _, d := range mp.MP {
+		if !isFinite(d) {
+			continue
+		}
+		var b int
+		if width > 0 {
+			b = int((d - minDist) / width)
+		}
+		if b >= bins {
+			b = bins - 1
+		}
+		counts[b]++
+	}
+
+	return counts, edges, nil
+}
+
+func getHistogram(c *gin.Context) {
+	start := time.Now()
+	endpoint := "/api/v1/histogram"
+	method := "GET"
+	session := sessions.Default(c)
+	buildCORSHeaders(c)
+
+	bins, err := strconv.Atoi(c.Query("bins"))
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	v := fetchMPCache(session)
+	var mp matrixprofile.MatrixProfile
+	if v == nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{
+			Error:        errors.New("matrix profile is not initialized to compute a histogram"),
+			CacheExpired: true,
+		})
+		return
+	} else {
+		mp = v.(matrixprofile.MatrixProfile)
+	}
+
+	counts, edges, err := mpHistogram(mp, bins)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	requestTotal.WithLabelValues(method, endpoint, "200").Inc()
+	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+	c.JSON(200, Histogram{
+		M:         mp.M,
+		Algorithm: fetchComputeParams(session).Algorithm,
+		Counts:    counts,
+		Edges:     edges,
+	})
+}
+
+func getSummary(c *gin.Context) {
+	start := time.Now()
+	endpoint := "/api/v1/summary"
+	method := "GET"
+	session := sessions.Default(c)
+	buildCORSHeaders(c)
+
+	v := fetchMPCache(session)
+	var mp matrixprofile.MatrixProfile
+	if v == nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{
+			Error:        errors.New("matrix profile is not initialized to compute a summary"),
+			CacheExpired: true,
+		})
+		return
+	} else {
+		mp = v.(matrixprofile.MatrixProfile)
+	}
+
+	summary, err := summarize(mp)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	summary.Algorithm = fetchComputeParams(session).Algorithm
+
+	requestTotal.WithLabelValues(method, endpoint, "200").Inc()
+	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+	c.JSON(200, summary)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/aouyang1/go-matrixprofile/matrixprofile"
+)
+
+// neighborProfile builds a matrix profile with the given index and a distance of
+// 1 everywhere
+func neighborProfile(m int, idx []int) matrixprofile.MatrixProfile {
+	mp := matrixprofile.MatrixProfile{M: m, MP: make([]float64, len(idx)), Idx: idx}
+	for i := range mp.MP {
+		mp.MP[i] = 1
+	}
+	return mp
+}
+
+func TestDominantPeriod(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	testData := []struct {
+		period int
+		// maxRepeats is the largest number of periods between a subsequence and
+		// its nearest neighbor
+		maxRepeats int
+		jitter     int
+	}{
+		{50, 1, 0},
+		{50, 3, 0},
+		{37, 2, 1},
+		{120, 4, 2},
+	}
+
+	for _, d := range testData {
+		n := 2000
+		idx := make([]int, n)
+		for i := range idx {
+			j := -1
+			for j < 0 || j >= n {
+				k := 1 + r.Intn(d.maxRepeats)
+				if r.Intn(2) == 0 {
+					k = -k
+				}
+				j = i + k*d.period
+				if d.jitter > 0 {
+					j += r.Intn(2*d.jitter+1) - d.jitter
+				}
+			}
+			idx[i] = j
+		}
+
+		period, confidence, err := dominantPeriod(neighborProfile(20, idx))
+		if err != nil {
+			t.Fatalf("unexpected error for a period of %d: %v", d.period, err)
+		}
+		if period < d.period-1 || period > d.period+1 {
+			t.Errorf("expected a period of %d but got %d", d.period, period)
+		}
+		if confidence < 0.8 {
+			t.Errorf("expected a confidence above 0.8 for a period of %d but got %f", d.period, confidence)
+		}
+	}
+}
+
+func TestDominantPeriodNonPeriodic(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	n := 2000
+	idx := make([]int, n)
+	for i := range idx {
+		idx[i] = r.Intn(n)
+	}
+
+	period, confidence, err := dominantPeriod(neighborProfile(20, idx))
+	if err == nil && confidence > 0.3 {
+		t.Errorf("expected no period or a low confidence for random neighbors but got %d with %f", period, confidence)
+	}
+}
+
+func TestDominantPeriodNoNeighbors(t *testing.T) {
+	// every neighbor is within the exclusion zone
+	idx := make([]int, 100)
+	for i := range idx {
+		idx[i] = i + 1
+	}
+	idx[len(idx)-1] = len(idx) - 2
+
+	if _, _, err := dominantPeriod(neighborProfile(20, idx)); err == nil {
+		t.Error("expected an error when no neighbors are outside the exclusion zone")
+	}
+}
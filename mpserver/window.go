@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	numSuggestedWindows = 3    // default number of candidate window sizes returned
+	minSuggestedWindow  = 4    // smallest window size that will be suggested
+	maxSuggestedWindow  = 1000 // largest window size that will be suggested
+)
+
+type Windows struct {
+	Windows []int `json:"windows"`
+}
+
+// suggestWindows proposes up to k window sizes for a series ranked from most to
+// least likely. Candidates are the lags at which the autocorrelation of the series
+// peaks, which correspond to the dominant periods in the data. This is a starting
+// point rather than a guarantee of a good window size.
+func suggestWindows(series []float64, k int) ([]int, error) {
+	if k < 1 {
+		return nil, errors.New("number of suggested windows must be at least 1")
+	}
+
+	maxLag := len(series) / 4
+	if maxLag > maxSuggestedWindow {
+		maxLag = maxSuggestedWindow
+	}
+	if maxLag <= minSuggestedWindow {
+		return nil, errors.New("series is too short to suggest a window size")
+	}
+
+	acf := autocorrelation(series, maxLag)
+	if acf == nil {
+		return nil, errors.New("series has no variance to suggest a window size from")
+	}
+
+	var peaks []int
+	for lag := minSuggestedWindow; lag < maxLag; lag++ {
+		if acf[lag] > 0 && acf[lag] > acf[lag-1] && acf[lag] >= acf[lag+1] {
+			peaks = append(peaks, lag)
+		}
+	}
+	if len(peaks) == 0 {
+		return nil, errors.New("no dominant period found to suggest a window size")
+	}
+
+	sort.SliceStable(peaks, func(i, j int) bool {
+		return acf[peaks[i]] > acf[peaks[j]]
+	})
+	if len(peaks) > k {
+		peaks = peaks[:k]
+	}
+	return peaks, nil
+}
+
+// autocorrelation computes the normalized autocorrelation of the series for lags
+// 0 through maxLag. nil is returned if the series is constant.
+func autocorrelation(series []float64, maxLag int) []float64 {
+	var mean float64
+	for _, v := range series {
+		mean += v
+	}
+	mean /= float64(len(series))
+
+	var variance float64
+	for _, v := range series {
+		variance += (v - mean) * (v - mean)
+	}
+	if variance == 0 {
+		return nil
+	}
+
+	acf := make([]float64, maxLag+1)
+	for lag := 0; lag <= maxLag; lag++ {
+		var sum float64
+		for i := 0; i+lag < len(series); i++ {
+			sum += (series[i] - mean) * (series[i+lag] - mean)
+		}
+		acf[lag] = sum / variance
+	}
+	return acf
+}
+
+func getWindows(c *gin.Context) {
+	start := time.Now()
+	endpoint := "/api/v1/windows"
+	method := "GET"
+	buildCORSHeaders(c)
+
+	k, err := strconv.Atoi(c.DefaultQuery("k", strconv.Itoa(numSuggestedWindows)))
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	data, err := fetchData(c.Query("source"))
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	windows, err := suggestWindows(data.Data, k)
+	if err != nil {
+		requestTotal.WithLabelValues(method, endpoint, "500").Inc()
+		serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+		c.JSON(500, RespError{Error: err})
+		return
+	}
+
+	requestTotal.WithLabelValues(method, endpoint, "200").Inc()
+	serviceRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds() * 1000)
+	c.JSON(200, Windows{windows})
+}